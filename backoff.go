@@ -0,0 +1,26 @@
+package go_mongo_repository
+
+import (
+	"time"
+)
+
+// exponentialBackoff returns the delay before the given attempt (starting at 1), doubling minDelay on every
+// attempt and never exceeding maxDelay.
+func exponentialBackoff(attempt int, minDelay time.Duration, maxDelay time.Duration) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := minDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= maxDelay || delay <= 0 {
+			return maxDelay
+		}
+	}
+
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
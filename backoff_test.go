@@ -0,0 +1,27 @@
+package go_mongo_repository
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	cases := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{attempt: 0, expected: time.Second},
+		{attempt: 1, expected: time.Second},
+		{attempt: 2, expected: 2 * time.Second},
+		{attempt: 4, expected: 8 * time.Second},
+		{attempt: 10, expected: time.Minute},
+		{attempt: 1000, expected: time.Minute},
+	}
+
+	for _, c := range cases {
+		delay := exponentialBackoff(c.attempt, time.Second, time.Minute)
+		if delay != c.expected {
+			t.Fatalf("attempt %d: expected %s, got %s", c.attempt, c.expected, delay)
+		}
+	}
+}
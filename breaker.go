@@ -0,0 +1,237 @@
+package go_mongo_repository
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+var (
+	// ErrCircuitOpen is returned without calling the server while the circuit of the connector is open.
+	ErrCircuitOpen = errors.New("the circuit of the connector is open")
+
+	// ErrTooManyInFlight is returned when the repository already runs RepositoryOptions.MaxInFlight operations.
+	ErrTooManyInFlight = errors.New("too many operations in flight")
+
+	// errOperationPanicked is recorded as a failure for the operations that panic.
+	errOperationPanicked = errors.New("the operation panicked")
+)
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"   // The operations run
+	CircuitOpen     CircuitState = "open"     // The operations fail with ErrCircuitOpen
+	CircuitHalfOpen CircuitState = "halfOpen" // A probe runs, the other operations fail with ErrCircuitOpen
+)
+
+type CircuitBreakerOptions struct {
+	FailureThreshold int           // Consecutive failures that open the circuit. Defaults to 5
+	SlowThreshold    time.Duration // Operations slower than this count as failures. Zero disables it
+	OpenTimeout      time.Duration // Time the circuit stays open before a probe is let through. Defaults to 30s
+	HalfOpenProbes   int           // Consecutive successful probes that close the circuit. Defaults to 1
+}
+
+// circuitBreaker fails the operations fast while the connector keeps failing. Only the errors of the server or the
+// network count as failures, not those of the application like a duplicated key. The generation changes with the
+// state, so the results of the operations allowed before the change are ignored.
+type circuitBreaker struct {
+	mutex      sync.Mutex
+	options    CircuitBreakerOptions
+	state      CircuitState
+	generation uint64
+	failures   int
+	successes  int
+	probing    bool
+	openedAt   time.Time
+}
+
+func newCircuitBreaker(opts CircuitBreakerOptions) *circuitBreaker {
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 5
+	}
+
+	if opts.OpenTimeout <= 0 {
+		opts.OpenTimeout = 30 * time.Second
+	}
+
+	if opts.HalfOpenProbes <= 0 {
+		opts.HalfOpenProbes = 1
+	}
+
+	return &circuitBreaker{options: opts, state: CircuitClosed}
+}
+
+// allow returns ErrCircuitOpen when the operation must not run, otherwise the generation to record its result with.
+// Once the open timeout elapses a single probe is let through at a time.
+func (breaker *circuitBreaker) allow() (uint64, error) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	switch breaker.state {
+	case CircuitOpen:
+		if time.Since(breaker.openedAt) < breaker.options.OpenTimeout {
+			return 0, ErrCircuitOpen
+		}
+		breaker.setState(CircuitHalfOpen)
+		breaker.successes = 0
+		breaker.probing = true
+	case CircuitHalfOpen:
+		if breaker.probing {
+			return 0, ErrCircuitOpen
+		}
+		breaker.probing = true
+	}
+
+	return breaker.generation, nil
+}
+
+// record updates the circuit with the result of an operation allowed in the generation and returns the previous and
+// the new state. The results of a previous generation are ignored.
+func (breaker *circuitBreaker) record(err error, duration time.Duration, generation uint64) (CircuitState, CircuitState) {
+	failed := err == errOperationPanicked || isConnectorFailure(err) ||
+		(breaker.options.SlowThreshold > 0 && duration > breaker.options.SlowThreshold)
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	previous := breaker.state
+	if generation != breaker.generation {
+		return previous, previous
+	}
+
+	switch breaker.state {
+	case CircuitHalfOpen:
+		breaker.probing = false
+		if failed {
+			breaker.open()
+			break
+		}
+
+		breaker.successes++
+		if breaker.successes >= breaker.options.HalfOpenProbes {
+			breaker.setState(CircuitClosed)
+			breaker.failures = 0
+		}
+	case CircuitClosed:
+		if !failed {
+			breaker.failures = 0
+			break
+		}
+
+		breaker.failures++
+		if breaker.failures >= breaker.options.FailureThreshold {
+			breaker.open()
+		}
+	}
+
+	return previous, breaker.state
+}
+
+func (breaker *circuitBreaker) open() {
+	breaker.setState(CircuitOpen)
+	breaker.openedAt = time.Now()
+	breaker.failures = 0
+	breaker.successes = 0
+}
+
+func (breaker *circuitBreaker) setState(state CircuitState) {
+	breaker.state = state
+	breaker.generation++
+}
+
+func (breaker *circuitBreaker) getState() CircuitState {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	return breaker.state
+}
+
+// isConnectorFailure tells whether the error comes from an unavailable or degraded server.
+func isConnectorFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var selectionErr topology.ServerSelectionError
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.As(err, &selectionErr)
+}
+
+// CircuitState returns the state of the circuit of the connector, closed when it has no circuit breaker.
+func (receiver *MongoConnector) CircuitState() CircuitState {
+	if receiver.breaker == nil {
+		return CircuitClosed
+	}
+
+	return receiver.breaker.getState()
+}
+
+// guard runs an operation of a single attempt within the in-flight limit of the repository and the circuit breaker
+// of its connector.
+func (repository *MongoRepository[T]) guard(fn func() error) error {
+	release, err := repository.acquireSlot()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return repository.guardCircuit(fn)
+}
+
+// acquireSlot takes a slot of the in-flight limit of the repository, held until release is called.
+func (repository *MongoRepository[T]) acquireSlot() (release func(), err error) {
+	if repository.bulkhead == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case repository.bulkhead <- struct{}{}:
+		return func() { <-repository.bulkhead }, nil
+	default:
+		return nil, ErrTooManyInFlight
+	}
+}
+
+// guardCircuit runs one attempt of an operation within the circuit breaker of the connector.
+func (repository *MongoRepository[T]) guardCircuit(fn func() error) error {
+	var breaker *circuitBreaker
+	if repository.connector != nil {
+		breaker = repository.connector.breaker
+	}
+
+	if breaker == nil {
+		return fn()
+	}
+
+	generation, err := breaker.allow()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	completed := false
+	defer func() {
+		// A panic must not leave the probe of a half open circuit running forever
+		if !completed {
+			repository.recordCircuit(breaker, errOperationPanicked, time.Since(start), generation)
+		}
+	}()
+
+	err = fn()
+	completed = true
+	repository.recordCircuit(breaker, err, time.Since(start), generation)
+	return err
+}
+
+func (repository *MongoRepository[T]) recordCircuit(breaker *circuitBreaker, err error, duration time.Duration, generation uint64) {
+	if previous, state := breaker.record(err, duration, generation); state != previous {
+		repository.datasource.getLogger().Warn("connector circuit state changed",
+			"connector", repository.connector.options.Name,
+			"from", previous,
+			"to", state,
+		)
+	}
+}
@@ -0,0 +1,204 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 2, OpenTimeout: 20 * time.Millisecond, SlowThreshold: time.Second})
+	networkErr := mongo.CommandError{Labels: []string{LabelNetworkError}}
+
+	generation, _ := breaker.allow()
+	breaker.record(networkErr, 0, generation)
+	breaker.record(mongo.ErrNoDocuments, 0, generation)
+	breaker.record(networkErr, 0, generation)
+	if breaker.getState() != CircuitClosed {
+		t.Fatal("the application errors must reset the consecutive failures")
+	}
+
+	if previous, state := breaker.record(nil, 2*time.Second, generation); previous != CircuitClosed || state != CircuitOpen {
+		t.Fatalf("the slow operations must count as failures, got %s", state)
+	}
+
+	if _, err := breaker.allow(); err != ErrCircuitOpen {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	probe, err := breaker.allow()
+	if err != nil {
+		t.Fatalf("a probe must be let through after the open timeout, got %v", err)
+	}
+	if _, err := breaker.allow(); err != ErrCircuitOpen {
+		t.Fatal("only one probe must run at a time")
+	}
+
+	breaker.record(context.DeadlineExceeded, 0, probe)
+	if breaker.getState() != CircuitOpen {
+		t.Fatal("a failed probe must open the circuit again")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	probe, err = breaker.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, state := breaker.record(nil, 0, probe); state != CircuitClosed {
+		t.Fatalf("a successful probe must close the circuit, got %s", state)
+	}
+}
+
+func TestCircuitBreakerStaleResults(t *testing.T) {
+	breaker := newCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 1, OpenTimeout: 20 * time.Millisecond})
+	networkErr := mongo.CommandError{Labels: []string{LabelNetworkError}}
+
+	failing, _ := breaker.allow()
+	late, _ := breaker.allow()
+	breaker.record(networkErr, 0, failing)
+
+	time.Sleep(30 * time.Millisecond)
+	probe, err := breaker.allow()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The operation allowed before the circuit opened must neither close it nor free the probe
+	if previous, state := breaker.record(nil, 0, late); previous != CircuitHalfOpen || state != CircuitHalfOpen {
+		t.Fatalf("a stale result must be ignored, got %s", state)
+	}
+	if _, err := breaker.allow(); err != ErrCircuitOpen {
+		t.Fatal("a stale result must not free the probe")
+	}
+
+	if _, state := breaker.record(nil, 0, probe); state != CircuitClosed {
+		t.Fatalf("a successful probe must close the circuit, got %s", state)
+	}
+
+	// A probe result that arrives once the circuit closed is stale as well
+	breaker.record(networkErr, 0, probe)
+	if breaker.getState() != CircuitClosed {
+		t.Fatal("a stale failure must not open the circuit")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	logger := &recordingLogger{}
+	datasource := &MongoDatasource{}
+	datasource.SetLogger(logger)
+
+	connector := &MongoConnector{
+		options: &MongoConnectorOpts{Name: "db"},
+		breaker: newCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 1}),
+	}
+	repository := &MongoRepository[AssetTest]{
+		schema:     NewSchema(AssetTest{}),
+		connector:  connector,
+		datasource: datasource,
+		bulkhead:   make(chan struct{}, 1),
+	}
+
+	err := repository.guard(func() error {
+		return repository.guard(func() error { return nil })
+	})
+	if err != ErrTooManyInFlight {
+		t.Fatalf("expected ErrTooManyInFlight, got %v", err)
+	}
+
+	networkErr := mongo.CommandError{Labels: []string{LabelNetworkError}}
+	if err := repository.retry(context.Background(), nil, true, func() error { return networkErr }); !mongo.IsNetworkError(err) {
+		t.Fatalf("expected the network error, got %v", err)
+	}
+
+	calls := 0
+	err = repository.retry(context.Background(), nil, true, func() error {
+		calls++
+		return nil
+	})
+	if err != ErrCircuitOpen || calls != 0 || connector.CircuitState() != CircuitOpen {
+		t.Fatalf("expected ErrCircuitOpen without calling the server, got %v after %d calls", err, calls)
+	}
+
+	if len(logger.entries) != 1 || logger.entries[0].msg != "connector circuit state changed" {
+		t.Fatalf("invalid entries %+v", logger.entries)
+	}
+}
+
+func TestGuardRetryHoldsTheSlot(t *testing.T) {
+	datasource := &MongoDatasource{}
+	datasource.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, MinBackoff: 100 * time.Millisecond, Jitter: -1})
+	repository := &MongoRepository[AssetTest]{
+		schema:     NewSchema(AssetTest{}),
+		datasource: datasource,
+		bulkhead:   make(chan struct{}, 1),
+	}
+
+	networkErr := mongo.CommandError{Labels: []string{LabelNetworkError}}
+	failed := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		attempts := 0
+		done <- repository.retry(context.Background(), nil, true, func() error {
+			attempts++
+			if attempts == 1 {
+				close(failed)
+				return networkErr
+			}
+			return nil
+		})
+	}()
+
+	// The retrying operation keeps its slot during the backoff
+	<-failed
+	time.Sleep(20 * time.Millisecond)
+	if err := repository.guard(func() error { return nil }); err != ErrTooManyInFlight {
+		t.Fatalf("expected ErrTooManyInFlight during the backoff, got %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.guard(func() error { return nil }); err != nil {
+		t.Fatalf("the slot must be released after the last attempt, got %v", err)
+	}
+}
+
+func TestGuardPanic(t *testing.T) {
+	connector := &MongoConnector{
+		options: &MongoConnectorOpts{Name: "db"},
+		breaker: newCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 1, OpenTimeout: 20 * time.Millisecond}),
+	}
+	repository := &MongoRepository[AssetTest]{
+		schema:     NewSchema(AssetTest{}),
+		connector:  connector,
+		datasource: &MongoDatasource{},
+	}
+
+	guardPanic := func() (recovered interface{}) {
+		defer func() { recovered = recover() }()
+		_ = repository.guard(func() error { panic("boom") })
+		return nil
+	}
+
+	if recovered := guardPanic(); recovered != "boom" {
+		t.Fatalf("the panic must propagate, got %v", recovered)
+	}
+	if connector.CircuitState() != CircuitOpen {
+		t.Fatalf("a panic must count as a failure, got %s", connector.CircuitState())
+	}
+
+	// A panicking probe must open the circuit again instead of blocking the next probes
+	time.Sleep(30 * time.Millisecond)
+	guardPanic()
+	if connector.CircuitState() != CircuitOpen {
+		t.Fatalf("a panicking probe must open the circuit, got %s", connector.CircuitState())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := repository.guard(func() error { return nil }); err != nil || connector.CircuitState() != CircuitClosed {
+		t.Fatalf("expected the next probe to close the circuit, got %v", err)
+	}
+}
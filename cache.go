@@ -0,0 +1,348 @@
+package go_mongo_repository
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Cache stores encoded documents by key. Implementations must be safe for concurrent use.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(key string)
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// LRUCache is an in-memory Cache that evicts the least recently used entry once it reaches its capacity.
+type LRUCache struct {
+	mutex    sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+}
+
+func NewLRUCache(capacity int) *LRUCache {
+	if capacity <= 0 {
+		capacity = 1000
+	}
+
+	return &LRUCache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (cache *LRUCache) Get(key string) ([]byte, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := element.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		cache.removeElement(element)
+		return nil, false
+	}
+
+	cache.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (cache *LRUCache) Set(key string, value []byte, ttl time.Duration) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+		cache.order.MoveToFront(element)
+		return
+	}
+
+	cache.entries[key] = cache.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for cache.order.Len() > cache.capacity {
+		cache.removeElement(cache.order.Back())
+	}
+}
+
+func (cache *LRUCache) Delete(key string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[key]; ok {
+		cache.removeElement(element)
+	}
+}
+
+func (cache *LRUCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	return cache.order.Len()
+}
+
+func (cache *LRUCache) removeElement(element *list.Element) {
+	cache.order.Remove(element)
+	delete(cache.entries, element.Value.(*lruEntry).key)
+}
+
+type CacheOptions struct {
+	TTL time.Duration // Defaults to 1m
+}
+
+// CachedRepository is a read-through cache over FindById and FindOne. The writes of the underlying repository,
+// including those of its WithEvents copies and the pipelines with $merge or $out, invalidate the cached entries of
+// the model before and after they run: writes by id remove that document, inserts discard the filter entries and
+// any other write discards every entry. Writes made by other repositories or processes are not seen by the cache.
+// The FilterPolicy is applied before the cache is read. The calls with a session, a read preference or a read
+// concern, and those whose policy requires an index, are not cached.
+type CachedRepository[T IModel] struct {
+	*MongoRepository[T]
+	cache   Cache
+	options CacheOptions
+
+	// Generations are part of the keys, incrementing them discards the previous entries
+	idGeneration     atomic.Uint64
+	filterGeneration atomic.Uint64
+
+	// Incremented before and after each write. A read that overlaps a write does not fill the cache, since it may
+	// have read the document before the write
+	writes atomic.Uint64
+
+	// Collation suffixes of the id keys, a write by id removes the entry of each one
+	collationKeys sync.Map
+}
+
+func NewCachedRepository[T IModel](repository *MongoRepository[T], cache Cache, opts CacheOptions) *CachedRepository[T] {
+	if opts.TTL <= 0 {
+		opts.TTL = time.Minute
+	}
+
+	cached := &CachedRepository[T]{
+		MongoRepository: repository,
+		cache:           cache,
+		options:         opts,
+	}
+	repository.addWriteHook(cached.onWrite)
+
+	return cached
+}
+
+func (repository *CachedRepository[T]) FindById(id interface{}, filter lbq.Filter, opts ...*QueryOptions) (*T, error) {
+	if len(filter.Where) > 0 || len(filter.Fields) > 0 || len(filter.Include) > 0 {
+		return repository.FindOne(filter, append(opts, withId(id))...)
+	}
+
+	if !repository.cacheable(opts) {
+		return repository.MongoRepository.FindById(id, filter, opts...)
+	}
+
+	// The policy also applies to the order, limit and skip of the filter
+	if _, err := repository.parseFilter(filter, repository.queryOptions(opts)); err != nil {
+		return nil, err
+	}
+
+	key, err := repository.idKey(id, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return repository.readThrough(key, func() (*T, error) {
+		return repository.MongoRepository.FindById(id, filter, opts...)
+	})
+}
+
+func (repository *CachedRepository[T]) FindOne(filter lbq.Filter, opts ...*QueryOptions) (*T, error) {
+	if !repository.cacheable(opts) {
+		return repository.MongoRepository.FindOne(filter, opts...)
+	}
+
+	key, err := repository.filterKey(filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return repository.readThrough(key, func() (*T, error) {
+		return repository.MongoRepository.FindOne(filter, opts...)
+	})
+}
+
+// Invalidate discards every cached entry of the model.
+func (repository *CachedRepository[T]) Invalidate() {
+	repository.invalidateAll()
+}
+
+// cacheable reports whether the call can be served from the cache. The reads of a session may be part of a
+// transaction, and those with their own read preference or read concern may see another version of the documents.
+// RequireIndex is checked by explaining the query, so those calls always reach the server.
+func (repository *CachedRepository[T]) cacheable(opts []*QueryOptions) bool {
+	callOptions := mergeQueryOptions(opts...)
+	if callOptions.Session != nil || callOptions.ReadPreference != nil || callOptions.ReadConcern != nil {
+		return false
+	}
+
+	policy := repository.filterPolicy(callOptions)
+	return policy == nil || !policy.RequireIndex
+}
+
+func (repository *CachedRepository[T]) readThrough(key string, find func() (*T, error)) (*T, error) {
+	if data, ok := repository.cache.Get(key); ok {
+		receiver := new(T)
+		if err := bson.Unmarshal(data, receiver); err == nil {
+			return receiver, nil
+		}
+		repository.cache.Delete(key)
+	}
+
+	writes := repository.writes.Load()
+	receiver, err := find()
+	if err != nil || receiver == nil {
+		return receiver, err
+	}
+
+	if repository.writes.Load() != writes {
+		return receiver, nil
+	}
+
+	if data, err := bson.Marshal(receiver); err == nil {
+		repository.cache.Set(key, data, repository.options.TTL)
+	}
+
+	return receiver, nil
+}
+
+// onWrite is the write hook of the underlying repository.
+func (repository *CachedRepository[T]) onWrite(operation *Operation, queryOptions *QueryOptions) {
+	repository.writes.Add(1)
+
+	// The id of UpdateById and DeleteById
+	if queryOptions != nil && len(queryOptions.where) == 1 {
+		if id, ok := queryOptions.where["id"]; ok {
+			repository.invalidateId(id)
+			return
+		}
+	}
+
+	if operation != nil && (operation.Name == "Insert" || operation.Name == "InsertMany") {
+		repository.invalidateFilters()
+		return
+	}
+
+	repository.invalidateAll()
+}
+
+func (repository *CachedRepository[T]) invalidateId(id interface{}) {
+	key, err := repository.idKey(id, nil)
+	if err != nil {
+		repository.idGeneration.Add(1)
+		repository.invalidateFilters()
+		return
+	}
+
+	repository.cache.Delete(key)
+	repository.collationKeys.Range(func(collationKey, _ any) bool {
+		repository.cache.Delete(key + collationKey.(string))
+		return true
+	})
+	repository.invalidateFilters()
+}
+
+func (repository *CachedRepository[T]) invalidateFilters() {
+	repository.filterGeneration.Add(1)
+}
+
+func (repository *CachedRepository[T]) invalidateAll() {
+	repository.idGeneration.Add(1)
+	repository.filterGeneration.Add(1)
+}
+
+func (repository *CachedRepository[T]) idKey(id interface{}, opts []*QueryOptions) (string, error) {
+	normalisedId, err := normaliseId(id, repository.schema)
+	if err != nil {
+		return "", err
+	}
+
+	generation := repository.idGeneration.Load()
+	key := fmt.Sprintf("%s:id:%d:%s", repository.schema.Name, generation, normalisedId)
+
+	collationKey := repository.collationKey(opts)
+	if collationKey != "" {
+		repository.collationKeys.Store(collationKey, struct{}{})
+	}
+
+	return key + collationKey, nil
+}
+
+// normaliseId applies the field coercion of the filters to the id, so an ObjectID and its hex string are equal.
+func normaliseId(id interface{}, schema *Schema) (string, error) {
+	parsedFilter, err := lbFilterQuery(lbq.Filter{Where: lbq.Where{"id": id}}, schema)
+	if err != nil {
+		return "", err
+	}
+
+	normalisedId, err := json.Marshal(parsedFilter.Where)
+	if err != nil {
+		return "", err
+	}
+
+	return string(normalisedId), nil
+}
+
+// filterKey hashes the translated filter. encoding/json sorts the map keys, so equivalent filters share the key.
+// The filter is translated with the FilterPolicy, so the filters it rejects fail before the cache is read. The id
+// of FindById is part of the options.
+func (repository *CachedRepository[T]) filterKey(filter lbq.Filter, opts []*QueryOptions) (string, error) {
+	parsedFilter, err := repository.parseFilter(filter, repository.queryOptions(opts))
+	if err != nil {
+		return "", err
+	}
+
+	normalisedFilter, err := json.Marshal(parsedFilter)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha1.Sum(normalisedFilter)
+	generation := repository.filterGeneration.Load()
+	key := fmt.Sprintf("%s:filter:%d:%s", repository.schema.Name, generation, hex.EncodeToString(hash[:]))
+	return key + repository.collationKey(opts), nil
+}
+
+// collationKey distinguishes the entries read with a collation, which may match a different document.
+func (repository *CachedRepository[T]) collationKey(opts []*QueryOptions) string {
+	collation := repository.queryOptions(opts).Collation
+	if collation == nil {
+		return ""
+	}
+
+	encoded, err := json.Marshal(collation)
+	if err != nil {
+		return ""
+	}
+
+	return ":collation:" + string(encoded)
+}
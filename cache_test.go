@@ -0,0 +1,207 @@
+package go_mongo_repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+func TestLRUCache(t *testing.T) {
+	cache := NewLRUCache(2)
+	cache.Set("a", []byte("1"), 0)
+	cache.Set("b", []byte("2"), 0)
+
+	// "a" becomes the most recently used, so "b" is evicted
+	if _, ok := cache.Get("a"); !ok {
+		t.Fatal("expected a")
+	}
+	cache.Set("c", []byte("3"), 0)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Fatal("b must be evicted")
+	}
+
+	if cache.Len() != 2 {
+		t.Fatalf("expected 2 entries, got %d", cache.Len())
+	}
+
+	cache.Set("d", []byte("4"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, ok := cache.Get("d"); ok {
+		t.Fatal("d must be expired")
+	}
+
+	cache.Delete("a")
+	if _, ok := cache.Get("a"); ok {
+		t.Fatal("a must be deleted")
+	}
+}
+
+func TestCachedRepositoryKeys(t *testing.T) {
+	repository := NewCachedRepository[AssetTest](&MongoRepository[AssetTest]{schema: NewSchema(AssetTest{})}, NewLRUCache(10), CacheOptions{})
+
+	id := primitive.NewObjectID()
+	oidKey, err := repository.idKey(id, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hexKey, err := repository.idKey(id.Hex(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if oidKey != hexKey {
+		t.Fatalf("the id keys must match: %s != %s", oidKey, hexKey)
+	}
+
+	repository.invalidateId(id)
+	afterKey, _ := repository.idKey(id, nil)
+	if afterKey != oidKey {
+		t.Fatal("invalidating an id must not change the id generation")
+	}
+
+	repository.invalidateAll()
+	afterKey, _ = repository.idKey(id, nil)
+	if afterKey == oidKey {
+		t.Fatal("invalidating all the entries must change the id keys")
+	}
+}
+
+func TestCachedRepositoryInvalidation(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewLRUCache(10)
+	repository := NewCachedRepository[AssetTest](&MongoRepository[AssetTest]{
+		schema:         NewSchema(AssetTest{}),
+		collectionName: "Asset",
+		connector:      &MongoConnector{client: client, connected: true, options: &MongoConnectorOpts{Database: "test"}},
+	}, cache, CacheOptions{})
+
+	id := primitive.NewObjectID()
+	key, _ := repository.idKey(id, nil)
+
+	// A write that overlaps the read, e.g. an UpdateById that runs between the find and the Set
+	doc, err := repository.readThrough(key, func() (*AssetTest, error) {
+		repository.onWrite(nil, withId(id))
+		return &AssetTest{}, nil
+	})
+	if err != nil || doc == nil {
+		t.Fatalf("invalid document %+v, %v", doc, err)
+	}
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("a read that overlaps a write must not fill the cache")
+	}
+
+	if _, err := repository.readThrough(key, func() (*AssetTest, error) { return &AssetTest{}, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.Get(key); !ok {
+		t.Fatal("the document must be cached")
+	}
+
+	// The writes of the underlying repository invalidate the entry, even when they fail
+	if err := repository.MongoRepository.UpdateById(id, bson.M{"name": "tank"}); err != mongo.ErrClientDisconnected {
+		t.Fatalf("expected ErrClientDisconnected, got %v", err)
+	}
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("UpdateById must invalidate the entry")
+	}
+
+	var results []bson.M
+	err = repository.Aggregate([]bson.M{{"$merge": bson.M{"into": "Asset"}}}, &results)
+	if err != mongo.ErrClientDisconnected {
+		t.Fatalf("expected ErrClientDisconnected, got %v", err)
+	}
+	if afterKey, _ := repository.idKey(id, nil); afterKey == key {
+		t.Fatal("a pipeline with $merge must invalidate every entry")
+	}
+}
+
+func TestCachedRepositoryBypass(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewLRUCache(10)
+	repository := NewCachedRepository[AssetTest](&MongoRepository[AssetTest]{
+		Options:        RepositoryOptions{FilterPolicy: &FilterPolicy{FilterableFields: []string{"name"}}},
+		schema:         NewSchema(AssetTest{}),
+		collectionName: "Asset",
+		connector:      &MongoConnector{client: client, connected: true, options: &MongoConnectorOpts{Database: "test"}},
+	}, cache, CacheOptions{})
+
+	// A document cached by a trusted call is not served to an untrusted filter the policy rejects
+	filter := lbq.Filter{Where: lbq.Where{"icon": "tank"}}
+	trusted := NewQueryOptions().SetTrusted(true)
+	key, err := repository.filterKey(filter, []*QueryOptions{trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := bson.Marshal(AssetTest{})
+	cache.Set(key, data, 0)
+
+	if doc, err := repository.FindOne(filter, trusted); err != nil || doc == nil {
+		t.Fatalf("expected the cached document, got %+v, %v", doc, err)
+	}
+	if _, err := repository.FindOne(filter); err == nil {
+		t.Fatal("expected the policy to reject the filter before the cache is read")
+	}
+
+	// The reads of a session or with their own read preference go to the server
+	id := primitive.NewObjectID()
+	idKey, _ := repository.idKey(id, nil)
+	cache.Set(idKey, data, 0)
+
+	secondary := NewQueryOptions().SetReadPreference(readpref.Secondary())
+	if _, err := repository.FindById(id, lbq.Filter{}, secondary); err != mongo.ErrClientDisconnected {
+		t.Fatalf("expected ErrClientDisconnected, got %v", err)
+	}
+	if _, err := repository.FindById(id, lbq.Filter{}, NewQueryOptions().SetReadConcern(readconcern.Majority())); err != mongo.ErrClientDisconnected {
+		t.Fatalf("expected ErrClientDisconnected, got %v", err)
+	}
+	if doc, err := repository.FindById(id, lbq.Filter{}); err != nil || doc == nil {
+		t.Fatalf("expected the cached document, got %+v, %v", doc, err)
+	}
+}
+
+func TestCachedRepositoryIdInvalidation(t *testing.T) {
+	base := &MongoRepository[AssetTest]{schema: NewSchema(AssetTest{}), writeHooks: &writeHooks{}}
+
+	// A copy made before the cache shares its hooks
+	clone := base.WithEvents()
+
+	cache := NewLRUCache(10)
+	repository := NewCachedRepository[AssetTest](base, cache, CacheOptions{})
+
+	id := primitive.NewObjectID()
+	collation := NewQueryOptions().SetCollation(&options.Collation{Locale: "en", Strength: 1})
+	key, _ := repository.idKey(id, nil)
+	collationKey, _ := repository.idKey(id, []*QueryOptions{collation})
+	if key == collationKey {
+		t.Fatal("the collation must be part of the key")
+	}
+
+	cache.Set(key, []byte{}, 0)
+	cache.Set(collationKey, []byte{}, 0)
+
+	clone.notifyWrite(nil, withId(id))
+
+	if _, ok := cache.Get(key); ok {
+		t.Fatal("the write of the copy must invalidate the entry")
+	}
+	if _, ok := cache.Get(collationKey); ok {
+		t.Fatal("the entry read with a collation must be invalidated too")
+	}
+}
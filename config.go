@@ -0,0 +1,359 @@
+package go_mongo_repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"gopkg.in/yaml.v2"
+)
+
+// DatasourceConfig declares the connectors of a datasource.
+type DatasourceConfig struct {
+	Connectors        []ConnectorConfig `json:"connectors" yaml:"connectors"`
+	CountersConnector string            `json:"countersConnector,omitempty" yaml:"countersConnector,omitempty"`
+}
+
+type ConnectorConfig struct {
+	Name           string `json:"name" yaml:"name"`
+	URI            string `json:"uri" yaml:"uri"`
+	Database       string `json:"database" yaml:"database"`
+	Lazy           bool   `json:"lazy,omitempty" yaml:"lazy,omitempty"`                     // Connect on the first use
+	ReadPreference string `json:"readPreference,omitempty" yaml:"readPreference,omitempty"` // Default read preference mode of the repositories
+}
+
+// envReference matches the ${VAR} references of the config values. A $ without braces is kept, so it can be part
+// of a password.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// LoadDatasourceConfig reads a JSON or YAML config file. After decoding, the ${VAR} references in the string values
+// are replaced by the environment variables, so the credentials can stay out of the file.
+func LoadDatasourceConfig(path string) (DatasourceConfig, error) {
+	var config DatasourceConfig
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&config)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(content, &config)
+	default:
+		return config, fmt.Errorf("unsupported datasource config format %q, only JSON and YAML files are supported", ext)
+	}
+
+	if err != nil {
+		return config, fmt.Errorf("invalid datasource config %s: %w", path, err)
+	}
+
+	if err := config.expandEnv(); err != nil {
+		return config, fmt.Errorf("invalid datasource config %s: %w", path, err)
+	}
+
+	return config, nil
+}
+
+// expandEnv replaces the ${VAR} references of the string values. A reference to an unset variable is an error.
+func (config *DatasourceConfig) expandEnv() error {
+	values := []*string{&config.CountersConnector}
+	for i := range config.Connectors {
+		connector := &config.Connectors[i]
+		values = append(values, &connector.Name, &connector.URI, &connector.Database, &connector.ReadPreference)
+	}
+
+	for _, value := range values {
+		var missing []string
+		*value = envReference.ReplaceAllStringFunc(*value, func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			variable, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return variable
+		})
+
+		if len(missing) > 0 {
+			return fmt.Errorf("environment variable %s is not set", strings.Join(missing, ", "))
+		}
+	}
+
+	return nil
+}
+
+// DatasourceConfigFromEnv reads the connectors from the environment variables <PREFIX>_<NAME>_URI, _DATABASE,
+// _LAZY and _READ_PREFERENCE, and the counters connector from <PREFIX>_COUNTERS_CONNECTOR. The connector names
+// are lower case. The prefix defaults to DATASOURCE.
+func DatasourceConfigFromEnv(prefix string) (DatasourceConfig, error) {
+	return datasourceConfigFromEnviron(prefix, os.Environ())
+}
+
+func datasourceConfigFromEnviron(prefix string, environ []string) (DatasourceConfig, error) {
+	if prefix == "" {
+		prefix = "DATASOURCE"
+	}
+	prefix += "_"
+
+	var config DatasourceConfig
+	connectors := map[string]*ConnectorConfig{}
+	connector := func(name string) *ConnectorConfig {
+		name = strings.ToLower(name)
+		if connectors[name] == nil {
+			connectors[name] = &ConnectorConfig{Name: name}
+		}
+		return connectors[name]
+	}
+
+	for _, variable := range environ {
+		key, value, _ := strings.Cut(variable, "=")
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		key = strings.TrimPrefix(key, prefix)
+
+		switch {
+		case key == "COUNTERS_CONNECTOR":
+			config.CountersConnector = strings.ToLower(value)
+		case strings.HasSuffix(key, "_URI"):
+			connector(strings.TrimSuffix(key, "_URI")).URI = value
+		case strings.HasSuffix(key, "_DATABASE"):
+			connector(strings.TrimSuffix(key, "_DATABASE")).Database = value
+		case strings.HasSuffix(key, "_READ_PREFERENCE"):
+			connector(strings.TrimSuffix(key, "_READ_PREFERENCE")).ReadPreference = value
+		case strings.HasSuffix(key, "_LAZY"):
+			lazy, err := strconv.ParseBool(value)
+			if err != nil {
+				return config, fmt.Errorf("invalid %s%s: %w", prefix, key, err)
+			}
+			connector(strings.TrimSuffix(key, "_LAZY")).Lazy = lazy
+		}
+	}
+
+	names := make([]string, 0, len(connectors))
+	for name := range connectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		config.Connectors = append(config.Connectors, *connectors[name])
+	}
+
+	return config, nil
+}
+
+// Validate checks the config without connecting to the servers.
+func (config DatasourceConfig) Validate() error {
+	if len(config.Connectors) == 0 {
+		return errors.New("the datasource config has no connectors")
+	}
+
+	names := map[string]bool{}
+	for _, connector := range config.Connectors {
+		if connector.Name == "" {
+			return errors.New("the connector name is required")
+		}
+
+		if names[connector.Name] {
+			return fmt.Errorf("duplicated connector %s", connector.Name)
+		}
+		names[connector.Name] = true
+
+		if _, err := connector.options(); err != nil {
+			return err
+		}
+	}
+
+	if config.CountersConnector != "" && !names[config.CountersConnector] {
+		return fmt.Errorf("the counters connector %s is not declared", config.CountersConnector)
+	}
+
+	return nil
+}
+
+func (config ConnectorConfig) options() (MongoConnectorOpts, error) {
+	opts := MongoConnectorOpts{
+		Name:     config.Name,
+		Database: config.Database,
+		Lazy:     config.Lazy,
+	}
+
+	if config.URI == "" {
+		return opts, fmt.Errorf("the uri of the connector %s is required", config.Name)
+	}
+
+	if config.Database == "" {
+		return opts, fmt.Errorf("the database of the connector %s is required", config.Name)
+	}
+
+	clientOptions := options.Client().ApplyURI(config.URI)
+	if err := clientOptions.Validate(); err != nil {
+		return opts, fmt.Errorf("invalid uri of the connector %s: %w", config.Name, err)
+	}
+	opts.ClientOptions = *clientOptions
+
+	if config.ReadPreference != "" {
+		mode, err := readpref.ModeFromString(config.ReadPreference)
+		if err != nil {
+			return opts, fmt.Errorf("invalid read preference of the connector %s: %w", config.Name, err)
+		}
+
+		opts.DefaultReadPreference, err = readpref.New(mode)
+		if err != nil {
+			return opts, fmt.Errorf("invalid read preference of the connector %s: %w", config.Name, err)
+		}
+	}
+
+	return opts, nil
+}
+
+// NewDatasourceFromConfig creates the connectors of the config. The connectors that are not lazy are connected and
+// pinged, and no connector is left open when one of them fails.
+func NewDatasourceFromConfig(config DatasourceConfig) (*MongoDatasource, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	datasource := &MongoDatasource{}
+	for _, connector := range config.Connectors {
+		opts, _ := connector.options()
+		if _, err := datasource.NewConnector(connector.Name, opts); err != nil {
+			datasource.Destroy()
+			return nil, fmt.Errorf("connector %s: %w", connector.Name, err)
+		}
+	}
+
+	if config.CountersConnector != "" {
+		if err := datasource.SetCountersConnector(config.CountersConnector); err != nil {
+			datasource.Destroy()
+			return nil, err
+		}
+	}
+
+	return datasource, nil
+}
+
+// Validate connects every connector, including the lazy ones, and returns an error listing the unreachable ones.
+func (receiver *MongoDatasource) Validate(ctx context.Context) error {
+	var messages []string
+	for _, health := range receiver.Health(ctx).Connectors {
+		if !health.Healthy {
+			messages = append(messages, fmt.Sprintf("connector %s: %s", health.Name, health.Error))
+		}
+	}
+
+	if len(messages) > 0 {
+		return errors.New("validate: " + strings.Join(messages, "; "))
+	}
+
+	return nil
+}
+
+// Reload applies the uri of the config to the connectors whose uri changed, for example to rotate the credentials,
+// and their read preference. The new clients are connected before any of them is applied, so a reload that fails
+// leaves the connectors as they were. The repositories keep working during the reload. Connectors cannot be added
+// or removed, nor change their database or lazy option.
+func (receiver *MongoDatasource) Reload(config DatasourceConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	if len(config.Connectors) != len(receiver.sortedConnectors()) {
+		return errors.New("the connectors cannot be added or removed by a reload")
+	}
+
+	connectors := make([]*MongoConnector, len(config.Connectors))
+	for i, connectorConfig := range config.Connectors {
+		connector, err := receiver.GetConnector(connectorConfig.Name)
+		if err != nil {
+			return err
+		}
+
+		current := connector.GetOptions()
+		if current.Database != connectorConfig.Database {
+			return fmt.Errorf("the database of the connector %s cannot change", connectorConfig.Name)
+		}
+
+		if current.Lazy != connectorConfig.Lazy {
+			return fmt.Errorf("the lazy option of the connector %s cannot change", connectorConfig.Name)
+		}
+		connectors[i] = connector
+	}
+
+	clients := make([]*mongo.Client, len(config.Connectors))
+	disconnectClients := func() {
+		for _, client := range clients {
+			if client != nil {
+				disconnectClient(client)
+			}
+		}
+	}
+
+	for i, connectorConfig := range config.Connectors {
+		current := connectors[i].GetOptions()
+		if current.GetURI() == connectorConfig.URI {
+			continue
+		}
+
+		opts, _ := connectorConfig.options()
+		client, err := connectors[i].newReloadClient(opts.ClientOptions)
+		if err != nil {
+			disconnectClients()
+			return fmt.Errorf("connector %s: %w", connectorConfig.Name, err)
+		}
+		clients[i] = client
+	}
+
+	for i, connectorConfig := range config.Connectors {
+		connector := connectors[i]
+		opts, _ := connectorConfig.options()
+
+		if !sameReadPreference(connector.GetOptions().DefaultReadPreference, opts.DefaultReadPreference) {
+			connector.setDefaultReadPreference(opts.DefaultReadPreference)
+			receiver.getLogger().Info("connector read preference changed",
+				"connector", connectorConfig.Name,
+				"readPreference", connectorConfig.ReadPreference,
+			)
+		}
+
+		if clients[i] == nil {
+			continue
+		}
+
+		// Only fails when the datasource is shut down meanwhile
+		client := clients[i]
+		clients[i] = nil
+		if err := connector.swapClient(client, opts.ClientOptions); err != nil {
+			disconnectClients()
+			return fmt.Errorf("connector %s: %w", connectorConfig.Name, err)
+		}
+
+		receiver.getLogger().Info("connector reloaded", "connector", connectorConfig.Name)
+	}
+
+	return nil
+}
+
+// sameReadPreference compares the modes of the read preferences, the only part set by the config.
+func sameReadPreference(a *readpref.ReadPref, b *readpref.ReadPref) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Mode() == b.Mode()
+}
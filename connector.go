@@ -3,20 +3,45 @@ package go_mongo_repository
 import (
 	"context"
 	"errors"
+	"sync"
+	"time"
+
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// ErrConnectorClosed is returned by a connector used after Disconnect.
+var ErrConnectorClosed = errors.New("the connector is disconnected")
+
 type MongoConnectorOpts struct {
 	options.ClientOptions
 	Name     string
 	Database string
+
+	// Read preference of the repository reads, while ClientOptions.ReadPreference applies to every operation
+	DefaultReadPreference *readpref.ReadPref
+
+	// Connect on the first use instead of in NewMongoConnector. The server is not pinged
+	Lazy bool
+
+	// Fails the repository operations fast while the server keeps failing. Nil disables it
+	CircuitBreaker *CircuitBreakerOptions
 }
 
 type MongoConnector struct {
 	ctx     context.Context
-	client  *mongo.Client
 	options *MongoConnectorOpts
+
+	mutex       sync.RWMutex
+	client      *mongo.Client
+	connected   bool
+	closed      bool                         // Set by Disconnect, the connector does not connect again
+	collections map[string]*mongo.Collection // Handles of the current client, reset by Reload
+	breaker     *circuitBreaker
+
+	healthMutex sync.Mutex
+	lastHealth  *ConnectorHealth
 }
 
 func NewMongoConnector(opts *MongoConnectorOpts) (*MongoConnector, error) {
@@ -26,48 +51,263 @@ func NewMongoConnector(opts *MongoConnectorOpts) (*MongoConnector, error) {
 		options: opts,
 	}
 
-	err := connector.connect()
+	client, err := newClient(opts)
 	if err != nil {
 		return nil, err
 	}
+	connector.client = client
+
+	if opts.CircuitBreaker != nil {
+		connector.breaker = newCircuitBreaker(*opts.CircuitBreaker)
+	}
+
+	if opts.Lazy {
+		return connector, nil
+	}
+
+	if err := connector.connect(); err != nil {
+		disconnectClient(client)
+		return nil, err
+	}
 
-	if err := connector.ping(); err != nil {
+	if err := connector.ping(ctx); err != nil {
+		disconnectClient(client)
 		return nil, err
 	}
 
 	return connector, nil
 }
 
+// disconnectClient closes a client that failed to connect or was not used.
+func disconnectClient(client *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_ = client.Disconnect(ctx)
+}
+
+func newClient(opts *MongoConnectorOpts) (*mongo.Client, error) {
+	clientOptions := opts.ClientOptions
+	return mongo.NewClient(&clientOptions)
+}
+
 func (receiver *MongoConnector) connect() error {
-	opts := receiver.options.ClientOptions
-	client, err := mongo.Connect(receiver.ctx, &opts)
+	_, err := receiver.getClient()
+	return err
+}
 
-	if err != nil {
-		return err
+// getClient returns the client, connecting it on the first use.
+func (receiver *MongoConnector) getClient() (*mongo.Client, error) {
+	receiver.mutex.RLock()
+	client, connected := receiver.client, receiver.connected
+	receiver.mutex.RUnlock()
+
+	if client == nil {
+		return nil, errors.New("go_mongo_repository client not initialized")
 	}
 
-	receiver.client = client
-	return nil
+	if connected {
+		return client, nil
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	if receiver.closed {
+		return nil, ErrConnectorClosed
+	}
+
+	if !receiver.connected {
+		if err := receiver.client.Connect(receiver.ctx); err != nil {
+			return nil, err
+		}
+		receiver.connected = true
+	}
+
+	return receiver.client, nil
 }
 
-func (receiver *MongoConnector) ping() error {
+// connectedClient returns the client without connecting a lazy connector, nil while it was not used.
+func (receiver *MongoConnector) connectedClient() (*mongo.Client, error) {
+	receiver.mutex.RLock()
+	defer receiver.mutex.RUnlock()
+
+	if receiver.closed {
+		return nil, ErrConnectorClosed
+	}
+
 	if receiver.client == nil {
-		return errors.New("go_mongo_repository client not initialized")
+		return nil, errors.New("go_mongo_repository client not initialized")
+	}
+
+	if !receiver.connected {
+		return nil, nil
+	}
+
+	return receiver.client, nil
+}
+
+func (receiver *MongoConnector) ping(ctx context.Context) error {
+	client, err := receiver.getClient()
+	if err != nil {
+		return err
 	}
-	return receiver.client.Ping(receiver.ctx, nil)
+	return client.Ping(ctx, nil)
 }
 
+// Disconnect closes the client. The connector does not connect again, its operations fail afterwards.
 func (receiver *MongoConnector) Disconnect() error {
+	return receiver.disconnect(receiver.ctx)
+}
+
+func (receiver *MongoConnector) disconnect(ctx context.Context) error {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
 	if receiver.client == nil {
 		return errors.New("go_mongo_repository client not initialized")
 	}
-	return receiver.client.Disconnect(receiver.ctx)
+
+	receiver.closed = true
+
+	// A lazy connector that was never used has nothing to disconnect
+	if !receiver.connected {
+		return nil
+	}
+
+	receiver.connected = false
+	return receiver.client.Disconnect(ctx)
 }
 
+// Reload replaces the client options, for example to rotate the credentials. The new client is connected and
+// pinged before it replaces the current one, which is disconnected once its running operations end.
+func (receiver *MongoConnector) Reload(clientOptions options.ClientOptions) error {
+	client, err := receiver.newReloadClient(clientOptions)
+	if err != nil {
+		return err
+	}
+
+	return receiver.swapClient(client, clientOptions)
+}
+
+// newReloadClient creates the client of a reload, connected and pinged. It is disconnected when it fails.
+func (receiver *MongoConnector) newReloadClient(clientOptions options.ClientOptions) (*mongo.Client, error) {
+	opts := receiver.GetOptions()
+	opts.ClientOptions = clientOptions
+
+	client, err := newClient(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := client.Connect(ctx); err != nil {
+		disconnectClient(client)
+		return nil, err
+	}
+
+	if err := client.Ping(ctx, nil); err != nil {
+		disconnectClient(client)
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// swapClient replaces the client with the one of newReloadClient. The new client is disconnected when the connector
+// is closed.
+func (receiver *MongoConnector) swapClient(client *mongo.Client, clientOptions options.ClientOptions) error {
+	receiver.mutex.Lock()
+	if receiver.closed {
+		receiver.mutex.Unlock()
+		disconnectClient(client)
+		return ErrConnectorClosed
+	}
+
+	previous, previousConnected := receiver.client, receiver.connected
+	receiver.client = client
+	receiver.connected = true
+	receiver.collections = nil
+	receiver.options.ClientOptions = clientOptions
+	receiver.mutex.Unlock()
+
+	if previousConnected {
+		// Disconnect waits for the connections in use until its context ends
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			defer cancel()
+			_ = previous.Disconnect(ctx)
+		}()
+	}
+
+	return nil
+}
+
+// GetDriver returns the client, connecting a lazy connector.
 func (receiver *MongoConnector) GetDriver() *mongo.Client {
-	return receiver.client
+	client, _ := receiver.getClient()
+	return client
 }
 
 func (receiver *MongoConnector) GetOptions() MongoConnectorOpts {
+	receiver.mutex.RLock()
+	defer receiver.mutex.RUnlock()
+
 	return *receiver.options
 }
+
+// defaultReadPreference returns the read preference of the repository reads, which can change on reload.
+func (receiver *MongoConnector) defaultReadPreference() *readpref.ReadPref {
+	receiver.mutex.RLock()
+	defer receiver.mutex.RUnlock()
+
+	return receiver.options.DefaultReadPreference
+}
+
+func (receiver *MongoConnector) setDefaultReadPreference(readPreference *readpref.ReadPref) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	receiver.options.DefaultReadPreference = readPreference
+}
+
+// getCollection returns the collection of the current client. When a lazy connector fails to connect the
+// operations of the collection return the error of the driver.
+func (receiver *MongoConnector) getCollection(name string) *mongo.Collection {
+	_, _ = receiver.getClient()
+
+	receiver.mutex.RLock()
+	collection, ok := receiver.collections[name]
+	receiver.mutex.RUnlock()
+	if ok {
+		return collection
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	if collection, ok = receiver.collections[name]; ok {
+		return collection
+	}
+
+	if receiver.collections == nil {
+		receiver.collections = make(map[string]*mongo.Collection)
+	}
+
+	collection = receiver.client.Database(receiver.options.Database).Collection(name)
+	receiver.collections[name] = collection
+	return collection
+}
+
+// StartCausalSession starts a causally consistent session. The reads made with the session see its previous
+// writes, even from a secondary. The caller must end the session.
+func (receiver *MongoConnector) StartCausalSession() (mongo.Session, error) {
+	client, err := receiver.getClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return client.StartSession(options.Session().SetCausalConsistency(true))
+}
@@ -0,0 +1,94 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const countersCollectionName = "Counter"
+
+type counter struct {
+	Name  string `bson:"_id"`
+	Value int64  `bson:"seq"`
+}
+
+// SetCountersConnector selects the connector that stores the sequence counters.
+func (receiver *MongoDatasource) SetCountersConnector(name string) error {
+	if _, err := receiver.GetConnector(name); err != nil {
+		return err
+	}
+
+	receiver.registryMutex.Lock()
+	defer receiver.registryMutex.Unlock()
+
+	receiver.countersConnector = name
+	return nil
+}
+
+// NextSequence increments the named counter and returns its new value. Counters start at 1.
+func (receiver *MongoDatasource) NextSequence(ctx context.Context, name string) (int64, error) {
+	first, _, err := receiver.NextSequenceRange(ctx, name, 1)
+	return first, err
+}
+
+// NextSequenceRange reserves n consecutive values of the named counter and returns the first and last.
+func (receiver *MongoDatasource) NextSequenceRange(ctx context.Context, name string, n int64) (int64, int64, error) {
+	connector, err := receiver.getCountersConnector()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return connector.nextSequenceRange(ctx, name, n)
+}
+
+func (receiver *MongoDatasource) getCountersConnector() (*MongoConnector, error) {
+	receiver.registryMutex.RLock()
+	defer receiver.registryMutex.RUnlock()
+
+	if receiver.countersConnector != "" {
+		connector, ok := receiver.connectors[receiver.countersConnector]
+		if !ok {
+			return nil, fmt.Errorf("connector with name %s does not exists", receiver.countersConnector)
+		}
+		return connector, nil
+	}
+
+	if len(receiver.connectors) != 1 {
+		return nil, errors.New("the counters connector is required when there are several connectors")
+	}
+
+	for _, connector := range receiver.connectors {
+		return connector, nil
+	}
+	return nil, nil
+}
+
+func (receiver *MongoConnector) nextSequenceRange(ctx context.Context, name string, n int64) (int64, int64, error) {
+	if name == "" {
+		return 0, 0, errors.New("the sequence name is required")
+	}
+
+	if n < 1 {
+		return 0, 0, fmt.Errorf("invalid sequence range size %d", n)
+	}
+
+	upsert := true
+	after := options.After
+
+	var result counter
+	err := receiver.getCollection(countersCollectionName).FindOneAndUpdate(ctx,
+		bson.M{"_id": name},
+		bson.M{"$inc": bson.M{"seq": n}},
+		&options.FindOneAndUpdateOptions{Upsert: &upsert, ReturnDocument: &after},
+	).Decode(&result)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return result.Value - n + 1, result.Value, nil
+}
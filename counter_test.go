@@ -0,0 +1,139 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestNextSequenceRangeConcurrent(t *testing.T) {
+	datasource := testDatasource(t)
+
+	const workers = 20
+	const reservations = 10
+
+	var mutex sync.Mutex
+	seen := map[int64]bool{}
+	var total int64
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(size int64) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			for j := 0; j < reservations; j++ {
+				first, last, err := datasource.NextSequenceRange(ctx, "concurrent", size)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				mutex.Lock()
+				total += size
+				for value := first; value <= last; value++ {
+					if seen[value] {
+						t.Errorf("value %d allocated twice", value)
+					}
+					seen[value] = true
+				}
+				mutex.Unlock()
+			}
+		}(int64(i%3 + 1))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Unique values that cover 1..total leave no gaps
+	if int64(len(seen)) != total {
+		t.Fatalf("expected %d values, got %d", total, len(seen))
+	}
+	for value := int64(1); value <= total; value++ {
+		if !seen[value] {
+			t.Fatalf("value %d was never allocated", value)
+		}
+	}
+}
+
+func TestInsertManySequences(t *testing.T) {
+	datasource := testDatasource(t)
+	repository, err := NewRepository[WorkOrderTest](datasource, RepositoryOptions{Created: true, Modified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inserted, err := repository.InsertMany([]WorkOrderTest{{}, {LegacyCode: 500}, {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orders, err := repository.Find(lbq.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != len(inserted) {
+		t.Fatalf("expected %d work orders, got %d", len(inserted), len(orders))
+	}
+
+	numbers := map[int64]bool{}
+	legacyCodes := map[int64]bool{}
+	for _, order := range orders {
+		numbers[order.Number] = true
+		legacyCodes[order.LegacyCode] = true
+	}
+
+	// One range per sequence, assigned only to the documents without a value
+	for _, number := range []int64{1, 2, 3} {
+		if !numbers[number] {
+			t.Fatalf("missing number %d in %v", number, numbers)
+		}
+	}
+	for _, code := range []int64{1, 2, 500} {
+		if !legacyCodes[code] {
+			t.Fatalf("missing legacy code %d in %v", code, legacyCodes)
+		}
+	}
+}
+
+func TestSequencesUseCountersConnector(t *testing.T) {
+	datasource := &MongoDatasource{}
+	for _, name := range []string{"db", "counters"} {
+		opts := MongoConnectorOpts{ClientOptions: *options.Client().ApplyURI("mongodb://localhost:27017"), Database: "test", Lazy: true}
+		if _, err := datasource.NewConnector(name, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repository, err := NewRepository[WorkOrderTest](datasource, RepositoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repository.assignSequences([]bson.M{{}}); err == nil {
+		t.Fatal("expected an error without a counters connector")
+	}
+
+	// The counters connector is closed, so using it fails at once while the one of the repository would connect
+	counters, _ := datasource.GetConnector("counters")
+	_ = counters.Disconnect()
+	if err := datasource.SetCountersConnector("counters"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repository.assignSequences([]bson.M{{}}); err != mongo.ErrClientDisconnected {
+		t.Fatalf("the sequences must be reserved in the counters connector, got %v", err)
+	}
+}
@@ -1,24 +1,57 @@
 package go_mongo_repository
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 )
 
 type MongoDatasource struct {
+	registryMutex        sync.RWMutex // Guards connectors, connectorByModelName and countersConnector
 	connectors           map[string]*MongoConnector
 	connectorByModelName map[string]*MongoConnector
+	countersConnector    string
+	instrumentsMutex     sync.RWMutex // Guards instrumentations
+	instrumentations     []Instrumentation
+	settingsMutex        sync.RWMutex // Guards logger and slowQueryThreshold
+	logger               Logger
+	slowQueryThreshold   time.Duration
+	retryPolicy          *RetryPolicy
+
+	inFlight         inFlightTracker
+	lifecycleMutex   sync.Mutex
+	shuttingDown     bool
+	stopHealthChecks context.CancelFunc
+	healthChecksDone chan struct{} // Closed when the health check goroutine exits
 }
 
+// NewConnector creates the connector and registers it with the name. A name already in use is an error, use
+// Reload to change the options of a registered connector.
 func (receiver *MongoDatasource) NewConnector(name string, clientOptions MongoConnectorOpts) (*MongoDatasource, error) {
 	clientOptions.Name = name
 	if clientOptions.Database == "" {
 		return nil, errors.New("database value is required")
 	}
+	if _, err := receiver.GetConnector(name); err == nil {
+		return nil, fmt.Errorf("connector with name %s already exists", name)
+	}
+
 	connector, err := NewMongoConnector(&clientOptions)
 	if err != nil {
 		return nil, err
 	}
+
+	receiver.registryMutex.Lock()
+	defer receiver.registryMutex.Unlock()
+
+	// Another goroutine may have created the connector while this one was connecting
+	if _, ok := receiver.connectors[name]; ok {
+		_ = connector.Disconnect()
+		return nil, fmt.Errorf("connector with name %s already exists", name)
+	}
+
 	if receiver.connectors == nil {
 		receiver.connectors = make(map[string]*MongoConnector)
 	}
@@ -26,19 +59,35 @@ func (receiver *MongoDatasource) NewConnector(name string, clientOptions MongoCo
 	return receiver, nil
 }
 
+// Destroy shuts the datasource down without waiting for the in-flight operations, and logs the errors. Use
+// Shutdown to wait for them and get the errors.
 func (receiver *MongoDatasource) Destroy() {
-	for _, connector := range receiver.connectors {
-		_ = connector.Disconnect()
+	if err := receiver.shutdown(context.Background(), false); err != nil {
+		receiver.getLogger().Error("datasource destroy failed", "error", err)
 	}
 }
 
+// RegisterModel binds the model to its connector. Registering the model again with the same connector does
+// nothing, while registering it with another connector is an error.
 func (receiver *MongoDatasource) RegisterModel(model IModel) error {
 	connectorName := model.GetConnectorName()
 	modelName := model.GetModelName()
-	connector, err := receiver.GetConnector(connectorName)
-	if err != nil {
-		return err
+
+	receiver.registryMutex.Lock()
+	defer receiver.registryMutex.Unlock()
+
+	connector, ok := receiver.connectors[connectorName]
+	if !ok {
+		return fmt.Errorf("connector with name %s does not exists", connectorName)
+	}
+
+	if registered, ok := receiver.connectorByModelName[modelName]; ok {
+		if registered != connector {
+			return fmt.Errorf("the model %s is already registered with the connector %s", modelName, registered.options.Name)
+		}
+		return nil
 	}
+
 	if receiver.connectorByModelName == nil {
 		receiver.connectorByModelName = make(map[string]*MongoConnector)
 	}
@@ -47,8 +96,24 @@ func (receiver *MongoDatasource) RegisterModel(model IModel) error {
 	return nil
 }
 
+// RegisteredModels returns the name of the connector of each registered model, by model name.
+func (receiver *MongoDatasource) RegisteredModels() map[string]string {
+	receiver.registryMutex.RLock()
+	defer receiver.registryMutex.RUnlock()
+
+	models := make(map[string]string, len(receiver.connectorByModelName))
+	for modelName, connector := range receiver.connectorByModelName {
+		models[modelName] = connector.options.Name
+	}
+
+	return models
+}
+
 func (receiver *MongoDatasource) GetModelConnector(model IModel) (*MongoConnector, error) {
+	receiver.registryMutex.RLock()
 	connector, ok := receiver.connectorByModelName[model.GetModelName()]
+	receiver.registryMutex.RUnlock()
+
 	if !ok {
 		return nil, fmt.Errorf("the model %s is not registered", model.GetModelName())
 	}
@@ -57,7 +122,10 @@ func (receiver *MongoDatasource) GetModelConnector(model IModel) (*MongoConnecto
 }
 
 func (receiver *MongoDatasource) GetConnector(name string) (*MongoConnector, error) {
+	receiver.registryMutex.RLock()
 	connector, ok := receiver.connectors[name]
+	receiver.registryMutex.RUnlock()
+
 	if !ok {
 		return nil, fmt.Errorf("connector with name %s does not exists", name)
 	}
@@ -1 +1,75 @@
 package go_mongo_repository
+
+import (
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// otherAssetTest shares the model name of AssetTest, but is stored in another connector.
+type otherAssetTest struct {
+	AssetTest
+}
+
+func (a otherAssetTest) GetConnectorName() string {
+	return "other"
+}
+
+func TestRegisterModel(t *testing.T) {
+	datasource := &MongoDatasource{}
+	for _, name := range []string{"db", "other"} {
+		opts := MongoConnectorOpts{ClientOptions: *options.Client().ApplyURI("mongodb://localhost:27017"), Database: "test", Lazy: true}
+		if _, err := datasource.NewConnector(name, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- datasource.RegisterModel(AssetTest{})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("registering the model again must not fail: %v", err)
+		}
+	}
+
+	if err := datasource.RegisterModel(otherAssetTest{}); err == nil {
+		t.Fatal("expected an error for a model registered with another connector")
+	}
+
+	models := datasource.RegisteredModels()
+	if len(models) != 1 || models["Asset"] != "db" {
+		t.Fatalf("invalid registered models %v", models)
+	}
+
+	// A connector with a name in use is an error, the repositories of the registered one keep working
+	repository, err := NewRepository[AssetTest](datasource, RepositoryOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := datasource.NewConnector("db", MongoConnectorOpts{Database: "replaced", Lazy: true}); err == nil {
+		t.Fatal("expected an error for a duplicated connector")
+	}
+
+	connector, _ := datasource.GetConnector("db")
+	if connector != repository.connector || connector.options.Database != "test" {
+		t.Fatal("the registered connector must not be replaced")
+	}
+	if _, err := repository.connector.getClient(); err != nil {
+		t.Fatalf("the connector of the repository must stay usable, got %v", err)
+	}
+	if repository.getCollection().Database().Name() != "test" {
+		t.Fatal("the repository must keep using the database of the registered connector")
+	}
+}
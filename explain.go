@@ -0,0 +1,284 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type ExplainVerbosity string
+
+const (
+	ExplainQueryPlanner      ExplainVerbosity = "queryPlanner"
+	ExplainExecutionStats    ExplainVerbosity = "executionStats"
+	ExplainAllPlansExecution ExplainVerbosity = "allPlansExecution"
+)
+
+// ExplainResult summarises the output of the explain command. The execution statistics are only filled with the
+// executionStats and allPlansExecution verbosities.
+type ExplainResult struct {
+	Stage          string   // Stage of the root of the winning plan
+	Stages         []string // Stages of the winning plan, from the root to the leaves, shard after shard
+	IndexName      string   // First index used by the winning plan
+	CollectionScan bool     // The winning plan scans the collection, in any of the shards
+	DocsExamined   int64
+	KeysExamined   int64
+	DocsReturned   int64
+	ExecutionTime  time.Duration
+	Raw            bson.M
+}
+
+// TestingT is the subset of testing.TB used by AssertNoCollectionScan.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// AssertNoCollectionScan fails the test when the explained query scans the collection.
+func AssertNoCollectionScan(t TestingT, result *ExplainResult) {
+	t.Helper()
+	if result == nil {
+		t.Errorf("the explain result is nil")
+		return
+	}
+
+	if result.CollectionScan {
+		t.Errorf("the query scans the collection, winning plan stages: %v", result.Stages)
+	}
+}
+
+// Explain runs the find of the filter through the explain command.
+func (repository *MongoRepository[T]) Explain(filter lbq.Filter, verbosity ExplainVerbosity, opts ...*QueryOptions) (*ExplainResult, error) {
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return repository.explain(repository.explainFindCommand(parsedFilter, queryOptions), verbosity)
+}
+
+// explainFindCommand is the find command of the filter, with its skip, limit and projection.
+func (repository *MongoRepository[T]) explainFindCommand(parsedFilter MongoFilter, queryOptions *QueryOptions) bson.D {
+	command := repository.findCommand(repository.fixQuery(parsedFilter.Where), parsedFilter.Options.Sort, queryOptions)
+	if parsedFilter.Options.Skip != nil {
+		command = append(command, bson.E{Key: "skip", Value: *parsedFilter.Options.Skip})
+	}
+	if parsedFilter.Options.Limit != nil {
+		command = append(command, bson.E{Key: "limit", Value: *parsedFilter.Options.Limit})
+	}
+	if projection := parsedFilter.Options.projection(); len(projection) > 0 {
+		command = append(command, bson.E{Key: "projection", Value: projection})
+	}
+
+	return command
+}
+
+// ExplainCount runs the count of the filter through the explain command.
+func (repository *MongoRepository[T]) ExplainCount(filter lbq.Filter, verbosity ExplainVerbosity, opts ...*QueryOptions) (*ExplainResult, error) {
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	command := bson.D{
+		{Key: "count", Value: repository.collectionName},
+		{Key: "query", Value: repository.fixQuery(parsedFilter.Where)},
+	}
+	if queryOptions.Collation != nil {
+		command = append(command, bson.E{Key: "collation", Value: bson.Raw(queryOptions.Collation.ToDocument())})
+	}
+
+	return repository.explain(command, verbosity)
+}
+
+// ExplainUpdate runs the update of the filter through the explain command, as UpdateMany does it. With the
+// executionStats verbosity the documents are not modified.
+func (repository *MongoRepository[T]) ExplainUpdate(filter lbq.Filter, update interface{}, verbosity ExplainVerbosity, opts ...*QueryOptions) (*ExplainResult, error) {
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	fixedUpdate, err := repository.fixUpdate(update, UpdateOptions{}, UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	statement := bson.D{
+		{Key: "q", Value: repository.fixQuery(parsedFilter.Where)},
+		{Key: "u", Value: fixedUpdate},
+		{Key: "multi", Value: true},
+	}
+	if queryOptions.Collation != nil {
+		statement = append(statement, bson.E{Key: "collation", Value: bson.Raw(queryOptions.Collation.ToDocument())})
+	}
+
+	return repository.explain(bson.D{
+		{Key: "update", Value: repository.collectionName},
+		{Key: "updates", Value: bson.A{statement}},
+	}, verbosity)
+}
+
+// ExplainDelete runs the delete of the filter through the explain command, as DeleteMany does it. Soft deletes are
+// explained as the update they are.
+func (repository *MongoRepository[T]) ExplainDelete(filter lbq.Filter, verbosity ExplainVerbosity, opts ...*QueryOptions) (*ExplainResult, error) {
+	if repository.Options.Deleted {
+		return repository.ExplainUpdate(filter, bson.M{"$currentDate": bson.M{"deleted": true}}, verbosity, opts...)
+	}
+
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := bson.D{
+		{Key: "q", Value: repository.fixQuery(parsedFilter.Where)},
+		{Key: "limit", Value: 0},
+	}
+	if queryOptions.Collation != nil {
+		statement = append(statement, bson.E{Key: "collation", Value: bson.Raw(queryOptions.Collation.ToDocument())})
+	}
+
+	return repository.explain(bson.D{
+		{Key: "delete", Value: repository.collectionName},
+		{Key: "deletes", Value: bson.A{statement}},
+	}, verbosity)
+}
+
+func (repository *MongoRepository[T]) findCommand(query bson.M, sort interface{}, queryOptions *QueryOptions) bson.D {
+	command := bson.D{{Key: "find", Value: repository.collectionName}, {Key: "filter", Value: query}}
+	if sort != nil {
+		command = append(command, bson.E{Key: "sort", Value: sort})
+	}
+	if queryOptions.Collation != nil {
+		command = append(command, bson.E{Key: "collation", Value: bson.Raw(queryOptions.Collation.ToDocument())})
+	}
+	if queryOptions.Hint != nil {
+		command = append(command, bson.E{Key: "hint", Value: queryOptions.Hint})
+	}
+
+	return command
+}
+
+// explain runs an explain requested by the caller, which counts in the bulkhead and the circuit breaker like the
+// other operations.
+func (repository *MongoRepository[T]) explain(command bson.D, verbosity ExplainVerbosity) (*ExplainResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var result *ExplainResult
+	err := repository.guard(func() error {
+		var err error
+		result, err = repository.explainContext(ctx, command, verbosity)
+		return err
+	})
+
+	return result, err
+}
+
+// explainContext runs the explain command. The internal explains, of the slow queries and of RequireIndex, call it
+// directly, so they do not take the slots of the bulkhead nor open the circuit breaker.
+func (repository *MongoRepository[T]) explainContext(ctx context.Context, command bson.D, verbosity ExplainVerbosity) (*ExplainResult, error) {
+	if verbosity == "" {
+		verbosity = ExplainQueryPlanner
+	}
+
+	var raw bson.M
+	err := repository.getCollection().Database().RunCommand(ctx, bson.D{
+		{Key: "explain", Value: command},
+		{Key: "verbosity", Value: string(verbosity)},
+	}).Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseExplain(raw)
+}
+
+// parseExplain reads the winning plan and the execution statistics of an explain output.
+func parseExplain(raw bson.M) (*ExplainResult, error) {
+	queryPlanner, _ := raw["queryPlanner"].(bson.M)
+	winningPlan, _ := queryPlanner["winningPlan"].(bson.M)
+	if winningPlan == nil {
+		return nil, errors.New("the query plan is not available")
+	}
+
+	result := &ExplainResult{Raw: raw}
+	plans := []bson.M{winningPlan}
+
+	// mongos merges the winning plans of the shards
+	if shards, ok := winningPlan["shards"].(bson.A); ok {
+		result.Stage, _ = winningPlan["stage"].(string)
+		result.Stages = append(result.Stages, result.Stage)
+
+		plans = nil
+		for _, shard := range shards {
+			shardExplain, _ := shard.(bson.M)
+			if shardPlan, ok := shardExplain["winningPlan"].(bson.M); ok {
+				plans = append(plans, shardPlan)
+			}
+		}
+
+		if len(plans) == 0 {
+			return nil, errors.New("the query plan of the shards is not available")
+		}
+	}
+
+	for _, plan := range plans {
+		// The slot based engine nests the classic plan in queryPlan
+		if queryPlan, ok := plan["queryPlan"].(bson.M); ok {
+			plan = queryPlan
+		}
+
+		if result.Stage == "" {
+			result.Stage, _ = plan["stage"].(string)
+		}
+		if !usesIndex(plan) {
+			result.CollectionScan = true
+		}
+		collectPlanStages(plan, result)
+	}
+
+	if executionStats, ok := raw["executionStats"].(bson.M); ok {
+		result.DocsExamined = toInt64(executionStats["totalDocsExamined"])
+		result.KeysExamined = toInt64(executionStats["totalKeysExamined"])
+		result.DocsReturned = toInt64(executionStats["nReturned"])
+		result.ExecutionTime = time.Duration(toInt64(executionStats["executionTimeMillis"])) * time.Millisecond
+	}
+
+	return result, nil
+}
+
+func collectPlanStages(plan bson.M, result *ExplainResult) {
+	if stage, ok := plan["stage"].(string); ok {
+		result.Stages = append(result.Stages, stage)
+	}
+
+	if indexName, ok := plan["indexName"].(string); ok && result.IndexName == "" {
+		result.IndexName = indexName
+	}
+
+	if inputStage, ok := plan["inputStage"].(bson.M); ok {
+		collectPlanStages(inputStage, result)
+	}
+
+	if inputStages, ok := plan["inputStages"].(bson.A); ok {
+		for _, inputStage := range inputStages {
+			if stage, ok := inputStage.(bson.M); ok {
+				collectPlanStages(stage, result)
+			}
+		}
+	}
+}
+
+func toInt64(val interface{}) int64 {
+	number, _ := toFloat64(val)
+	return int64(number)
+}
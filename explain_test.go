@@ -0,0 +1,150 @@
+package go_mongo_repository
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type recordingT struct {
+	errors []string
+}
+
+func (t *recordingT) Helper() {}
+
+func (t *recordingT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func TestParseExplain(t *testing.T) {
+	raw := bson.M{
+		"queryPlanner": bson.M{
+			"winningPlan": bson.M{
+				"stage": "FETCH",
+				"inputStage": bson.M{
+					"stage":     "IXSCAN",
+					"indexName": "referenceId_1",
+				},
+			},
+		},
+		"executionStats": bson.M{
+			"nReturned":           int32(3),
+			"totalDocsExamined":   int32(3),
+			"totalKeysExamined":   int64(4),
+			"executionTimeMillis": int32(12),
+		},
+	}
+
+	result, err := parseExplain(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Stage != "FETCH" || result.IndexName != "referenceId_1" || result.CollectionScan {
+		t.Fatalf("invalid plan summary %+v", result)
+	}
+
+	if result.DocsReturned != 3 || result.DocsExamined != 3 || result.KeysExamined != 4 || result.ExecutionTime != 12*time.Millisecond {
+		t.Fatalf("invalid execution stats %+v", result)
+	}
+
+	recorder := &recordingT{}
+	AssertNoCollectionScan(recorder, result)
+	if len(recorder.errors) != 0 {
+		t.Fatal("the plan uses an index")
+	}
+
+	// Slot based engine output
+	result, err = parseExplain(bson.M{
+		"queryPlanner": bson.M{
+			"winningPlan": bson.M{"queryPlan": bson.M{"stage": "COLLSCAN"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	AssertNoCollectionScan(recorder, result)
+	if len(recorder.errors) != 1 {
+		t.Fatal("the collection scan must be reported")
+	}
+
+	if _, err := parseExplain(bson.M{}); err == nil {
+		t.Fatal("an output without plan must fail")
+	}
+}
+
+func TestParseShardedExplain(t *testing.T) {
+	shardedExplain := func(shards ...bson.M) bson.M {
+		explains := bson.A{}
+		for i, plan := range shards {
+			explains = append(explains, bson.M{"shardName": fmt.Sprintf("shard%d", i), "winningPlan": plan})
+		}
+
+		return bson.M{
+			"queryPlanner": bson.M{
+				"winningPlan": bson.M{"stage": "SHARD_MERGE", "shards": explains},
+			},
+		}
+	}
+
+	indexScan := bson.M{"stage": "FETCH", "inputStage": bson.M{"stage": "IXSCAN", "indexName": "referenceId_1"}}
+
+	result, err := parseExplain(shardedExplain(indexScan, bson.M{"queryPlan": indexScan}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Stage != "SHARD_MERGE" || result.IndexName != "referenceId_1" || result.CollectionScan {
+		t.Fatalf("invalid plan summary %+v", result)
+	}
+	if fmt.Sprint(result.Stages) != "[SHARD_MERGE FETCH IXSCAN FETCH IXSCAN]" {
+		t.Fatalf("invalid stages %v", result.Stages)
+	}
+
+	// A single shard scanning its collection is enough to report the scan
+	result, err = parseExplain(shardedExplain(indexScan, bson.M{"stage": "SHARDING_FILTER", "inputStage": bson.M{"stage": "COLLSCAN"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &recordingT{}
+	AssertNoCollectionScan(recorder, result)
+	if !result.CollectionScan || len(recorder.errors) != 1 {
+		t.Fatalf("the collection scan of the shard must be reported, got %+v", result)
+	}
+
+	if _, err := parseExplain(shardedExplain()); err == nil {
+		t.Fatal("an output without the plans of the shards must fail")
+	}
+}
+
+func TestExplainFindCommand(t *testing.T) {
+	repository := &MongoRepository[AssetTest]{schema: NewSchema(AssetTest{}), collectionName: "Asset"}
+	queryOptions := repository.queryOptions(nil)
+
+	parsedFilter, err := repository.parseFilter(lbq.Filter{Where: lbq.Where{"name": "tank"}, Limit: 2}, queryOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command := repository.explainFindCommand(parsedFilter, queryOptions)
+	for _, element := range command {
+		if element.Key == "projection" {
+			t.Fatalf("a filter without fields must not send a projection, got %v", command)
+		}
+	}
+
+	parsedFilter, err = repository.parseFilter(lbq.Filter{Fields: lbq.Fields{"name": true}}, queryOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	command = repository.explainFindCommand(parsedFilter, queryOptions)
+	if last := command[len(command)-1]; last.Key != "projection" || last.Value.(bson.M)["name"] != true {
+		t.Fatalf("invalid projection %v", command)
+	}
+}
@@ -2,8 +2,9 @@ package go_mongo_repository
 
 import (
 	"errors"
-	"log"
+	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -25,6 +26,39 @@ var operators = map[string]string{
 	"and":    "$and",
 	"or":     "$or",
 	"exists": "$exists",
+
+	"between": "", // Translated to $gte and $lte
+	"regexp":  "$regex",
+	"not":     "$not",
+	"type":    "$type",
+	"mod":     "$mod",
+
+	"search": "$text",
+
+	"all":       "$all",
+	"size":      "$size",
+	"elemMatch": "$elemMatch",
+
+	"near":          "$near",
+	"geoWithin":     "$geoWithin",
+	"geoIntersects": "$geoIntersects",
+}
+
+// fieldNamedOperators are the operators whose names are also common field names. A key with one of these names is
+// a field when the schema declares it, so the filters on those fields keep working.
+var fieldNamedOperators = map[string]bool{
+	"between":       true,
+	"regexp":        true,
+	"not":           true,
+	"type":          true,
+	"mod":           true,
+	"search":        true,
+	"all":           true,
+	"size":          true,
+	"elemMatch":     true,
+	"near":          true,
+	"geoWithin":     true,
+	"geoIntersects": true,
 }
 
 const (
@@ -32,11 +66,15 @@ const (
 	DtDate     = "Date"
 )
 
+// TextScoreField is the order and fields name of the relevance of a text search
+const TextScoreField = "textScore"
+
 type MongoFilterOptions struct {
-	Limit  *int64
-	Skip   *int64
-	Sort   interface{}
-	Fields map[string]bool
+	Limit     *int64
+	Skip      *int64
+	Sort      interface{}
+	Fields    map[string]bool
+	TextScore bool // Project the text score in TextScoreField
 }
 
 type MongoIncludes struct {
@@ -48,14 +86,26 @@ type MongoFilter struct {
 	Where   bson.M
 	Options MongoFilterOptions
 	Include []MongoIncludes
+
+	DroppedFields []string `json:"-"` // Fields of the where that are not in the schema
 }
 
 func lbFilterQuery(filter lbq.Filter, schema *Schema) (MongoFilter, error) {
+	return lbFilterQueryWithPolicy(filter, schema, nil)
+}
+
+// lbFilterQueryWithPolicy translates the filter applying the restrictions of the policy. A nil policy applies none.
+func lbFilterQueryWithPolicy(filter lbq.Filter, schema *Schema, policy *FilterPolicy) (MongoFilter, error) {
 	where := filter.Where
 
 	result := MongoFilter{}
 
-	parsedWhere, err := buildWhere(where, "", schema.JSONFields)
+	if err := policy.checkFilter(filter, schema.JSONFields); err != nil {
+		return result, err
+	}
+
+	state := &whereState{policy: policy}
+	parsedWhere, err := buildWhere(where, "", schema.JSONFields, state)
 	if err != nil {
 		return result, err
 	}
@@ -70,11 +120,32 @@ func lbFilterQuery(filter lbq.Filter, schema *Schema) (MongoFilter, error) {
 		return result, errors.New("invalid order parameter")
 	}
 
+	for _, sortField := range parsedSort {
+		if sortField.Key == TextScoreField {
+			result.Options.TextScore = true
+		}
+	}
+
+	if filter.Fields[TextScoreField] {
+		result.Options.TextScore = true
+	}
+
+	if result.Options.TextScore && !hasTextSearch(parsedWhere) {
+		return result, errors.New("the text score requires a search condition")
+	}
+
 	result.Where = parsedWhere
+	if len(state.droppedFields) > 0 {
+		sort.Strings(state.droppedFields)
+		result.DroppedFields = state.droppedFields
+	}
 
 	result.Options.Sort = parsedSort
 	if filter.Limit != 0 {
 		result.Options.Limit = &filter.Limit
+	} else if policy != nil && policy.DefaultLimit > 0 {
+		defaultLimit := policy.DefaultLimit
+		result.Options.Limit = &defaultLimit
 	}
 	if filter.Skip != 0 {
 		result.Options.Skip = &filter.Skip
@@ -122,7 +193,10 @@ func buildSort(order []lbq.Order) bson.D {
 
 	sort := bson.D{}
 	for _, lbOrder := range order {
-		if lbOrder.Direction == "DESC" {
+		if lbOrder.Field == TextScoreField {
+			// The relevance is always sorted in descending order
+			sort = append(sort, bson.E{Key: TextScoreField, Value: bson.M{"$meta": "textScore"}})
+		} else if lbOrder.Direction == "DESC" {
 			sort = append(sort, bson.E{Key: lbOrder.Field, Value: -1})
 		} else {
 			sort = append(sort, bson.E{Key: lbOrder.Field, Value: 1})
@@ -132,7 +206,31 @@ func buildSort(order []lbq.Order) bson.D {
 	return sort
 }
 
-func buildWhere(where lbq.Where, parentField string, fields map[string]*Field) (bson.M, error) {
+// projection returns the projection of the query, including the text score when it is required. It is nil when
+// the query has no projection.
+func (filterOptions MongoFilterOptions) projection() bson.M {
+	if len(filterOptions.Fields) == 0 && !filterOptions.TextScore {
+		return nil
+	}
+
+	projection := bson.M{}
+	for key, val := range filterOptions.Fields {
+		projection[key] = val
+	}
+	if filterOptions.TextScore {
+		projection[TextScoreField] = bson.M{"$meta": "textScore"}
+	}
+
+	return projection
+}
+
+// whereState is shared by the buildWhere calls of a filter.
+type whereState struct {
+	policy        *FilterPolicy
+	droppedFields []string // Unknown fields, their conditions are ignored
+}
+
+func buildWhere(where lbq.Where, parentField string, fields map[string]*Field, state *whereState) (bson.M, error) {
 	if where == nil {
 		return bson.M{}, nil
 	}
@@ -149,6 +247,23 @@ func buildWhere(where lbq.Where, parentField string, fields map[string]*Field) (
 
 	exists, hasExistsCond := where["exists"]
 
+	near, hasNearCond := where["near"]
+	geoWithin, hasGeoWithinCond := where["geoWithin"]
+	geoIntersects, hasGeoIntersectsCond := where["geoIntersects"]
+
+	// The geo operators query a field, at the top level their keys can only be fields
+	if parentField == "" {
+		for _, key := range []string{"near", "geoWithin", "geoIntersects"} {
+			if _, ok := where[key]; !ok {
+				continue
+			}
+			if _, isField := fields[key]; !isField {
+				return nil, fmt.Errorf("invalid where parameter. %s is only allowed under a field", key)
+			}
+		}
+		hasNearCond, hasGeoWithinCond, hasGeoIntersectsCond = false, false, false
+	}
+
 	switch {
 	case hasExistsCond:
 		if _, ok := exists.(bool); !ok {
@@ -156,16 +271,42 @@ func buildWhere(where lbq.Where, parentField string, fields map[string]*Field) (
 		}
 		query["$exists"] = exists
 	case hasLikeCond:
+		like, opts, err := state.policy.like(like, opts)
+		if err != nil {
+			return nil, err
+		}
 		query["$regex"] = like
 		if opts != nil {
 			query["$options"] = opts
 		}
 	case hasNLikeCond:
+		nLike, opts, err := state.policy.like(nLike, opts)
+		if err != nil {
+			return nil, err
+		}
 		regex := bson.M{"$regex": nLike}
 		if opts != nil {
 			regex["$options"] = opts
 		}
 		query["$not"] = regex
+	case hasNearCond:
+		nearQuery, err := buildNear(near, where["maxDistance"], where["minDistance"])
+		if err != nil {
+			return nil, err
+		}
+		query["$near"] = nearQuery
+	case hasGeoWithinCond:
+		withinQuery, err := buildGeoWithin(geoWithin)
+		if err != nil {
+			return nil, err
+		}
+		query["$geoWithin"] = withinQuery
+	case hasGeoIntersectsCond:
+		intersectsQuery, err := buildGeoIntersects(geoIntersects)
+		if err != nil {
+			return nil, err
+		}
+		query["$geoIntersects"] = intersectsQuery
 	default:
 		for key, val := range where {
 			if strings.HasPrefix(key, "$") {
@@ -173,6 +314,13 @@ func buildWhere(where lbq.Where, parentField string, fields map[string]*Field) (
 			}
 
 			_mongoOp, isOperator := operators[key]
+			if isOperator && parentField == "" && fieldNamedOperators[key] {
+				if _, isField := fields[key]; isField {
+					isOperator = false
+				}
+			} else if isOperator && parentField != "" && !isNestedOperator(key, val, parentField, fields) {
+				isOperator = false
+			}
 			var operatorName string
 			var fieldName string
 			var field *Field
@@ -183,10 +331,10 @@ func buildWhere(where lbq.Where, parentField string, fields map[string]*Field) (
 				if err != nil {
 					return bson.M{}, err
 				}*/
-				_field, exists := getFieldIfExists(parentField, fields)
+				_field, bsonPath, exists := getSubField(parentField, fields)
 				if exists {
 					field = _field
-					fieldName = _field.BsonName
+					fieldName = bsonPath
 				}
 			} else {
 				/*_field, exists, err := getRootFieldIfExists(key, fields)
@@ -194,23 +342,138 @@ func buildWhere(where lbq.Where, parentField string, fields map[string]*Field) (
 					return bson.M{}, err
 				}*/
 
-				_field, exists := getFieldIfExists(key, fields)
+				_field, bsonPath, exists := getSubField(key, fields)
 				if !exists {
-					log.Println("field not exists")
+					state.droppedFields = append(state.droppedFields, key)
 					continue
 				}
 				field = _field
-				fieldName = field.BsonName
+				fieldName = bsonPath
 				operatorName = fieldName
 			}
 
+			// Operators with their own syntax are translated here, the rest share the coercion below
+			operatorKey := ""
+			rawVal := val
+			if isOperator && key != "and" && key != "or" {
+				operatorKey = key
+				val = unwrapEq(val)
+			}
+
+			switch operatorKey {
+			case "all":
+				// Validated here, the values are coerced below like those of inq
+				if _, ok := toInterfaceSlice(val); !ok {
+					return nil, errors.New("invalid where parameter. all requires a list of values")
+				}
+			case "size":
+				size, err := getArraySize(val)
+				if err != nil {
+					return nil, err
+				}
+				query[operatorName] = size
+				continue
+			case "search":
+				if parentField != "" {
+					return nil, errors.New("invalid where parameter. search is only allowed at the top level")
+				}
+				textQuery, err := buildTextSearch(val)
+				if err != nil {
+					return nil, err
+				}
+				query[operatorName] = textQuery
+				continue
+			case "between":
+				bounds, ok := toInterfaceSlice(val)
+				if !ok || len(bounds) != 2 {
+					return nil, errors.New("invalid where parameter. between requires two values")
+				}
+				if bounds[0] == nil || bounds[1] == nil {
+					return nil, errors.New("invalid where parameter. between values can not be null")
+				}
+				lower, okLower := coerceValue(field, "gte", bounds[0])
+				upper, okUpper := coerceValue(field, "lte", bounds[1])
+				if !okLower || !okUpper {
+					return nil, errors.New("invalid where parameter. invalid between values")
+				}
+				if !sameKind(lower, upper) {
+					return nil, errors.New("invalid where parameter. between values must have the same type")
+				}
+				query["$gte"] = lower
+				query["$lte"] = upper
+				continue
+			case "regexp":
+				pattern, regexOptions, err := parseRegexp(val)
+				if err != nil {
+					return nil, err
+				}
+				if err := state.policy.checkRegex(pattern, regexOptions); err != nil {
+					return nil, err
+				}
+				query["$regex"] = pattern
+				if regexOptions != "" {
+					query["$options"] = regexOptions
+				}
+				continue
+			case "not":
+				// The eq of the condition is kept, not: {eq: v} negates the equality
+				notWhere, ok := rawVal.(lbq.Where)
+				if !ok {
+					return nil, errors.New("invalid where parameter. not requires a condition")
+				}
+				notQuery, err := buildWhere(notWhere, parentField, fields, state)
+				if err != nil {
+					return nil, err
+				}
+				if len(notQuery) == 0 {
+					return nil, errors.New("invalid where parameter. invalid not condition")
+				}
+				// MongoDB has no top level $not, the conditions are negated with $nor
+				if parentField == "" {
+					query["$nor"] = bson.A{notQuery}
+					continue
+				}
+				for notKey := range notQuery {
+					if !strings.HasPrefix(notKey, "$") {
+						return nil, errors.New("invalid where parameter. not only accepts operators")
+					}
+				}
+				// $not does not accept $eq in every server version
+				if eq, ok := notQuery["$eq"]; ok && len(notQuery) == 1 {
+					query["$ne"] = eq
+					continue
+				}
+				query[operatorName] = notQuery
+				continue
+			case "type":
+				if err := validateBsonType(val); err != nil {
+					return nil, err
+				}
+				query[operatorName] = val
+				continue
+			case "mod":
+				mod, err := getModOperands(val)
+				if err != nil {
+					return nil, err
+				}
+				query[operatorName] = mod
+				continue
+			case "elemMatch":
+				elemMatch, err := buildElemMatch(val, parentField, field, fields, state)
+				if err != nil {
+					return nil, err
+				}
+				query[operatorName] = elemMatch
+				continue
+			}
+
 			switch v := val.(type) {
 			case lbq.AndOrCondition:
 				arr := v
 				barr := bson.A{}
 
 				for _, el := range arr {
-					whr, err := buildWhere(el, parentField, fields)
+					whr, err := buildWhere(el, parentField, fields, state)
 					if err != nil {
 						return bson.M{}, err
 					}
@@ -225,7 +488,7 @@ func buildWhere(where lbq.Where, parentField string, fields map[string]*Field) (
 
 				query[operatorName] = barr
 			case lbq.Where:
-				whr, err := buildWhere(v, key, fields)
+				whr, err := buildWhere(v, key, fields, state)
 				if err != nil {
 					return bson.M{}, err
 				}
@@ -233,46 +496,8 @@ func buildWhere(where lbq.Where, parentField string, fields map[string]*Field) (
 					query[fieldName] = whr
 				}
 			default:
-				switch field.DataType {
-				case DtObjectID:
-					if key == "inq" || key == "nin" {
-						arr, err := getObjectIdArray(val)
-						if err == nil {
-							query[operatorName] = arr
-						}
-					} else {
-						var oidVal any
-						var err error
-						if field.IsPointer {
-							oidVal, err = getObjectIdOrNil(val)
-						} else {
-							oidVal, err = getObjectId(val)
-						}
-
-						if err == nil {
-							query[operatorName] = oidVal
-						}
-					}
-				case DtDate:
-					if key == "inq" || key == "nin" {
-						arr, err := getDateArray(val)
-						if err == nil {
-							query[operatorName] = arr
-						}
-					} else {
-						var dateVal any
-						var err error
-						if field.IsPointer {
-							dateVal, err = getDateOrNil(val)
-						} else {
-							dateVal, err = getDate(val)
-						}
-						if err == nil {
-							query[operatorName] = dateVal
-						}
-					}
-				default:
-					query[operatorName] = val
+				if coercedVal, ok := coerceValue(field, key, val); ok {
+					query[operatorName] = coercedVal
 				}
 			}
 		}
@@ -281,6 +506,320 @@ func buildWhere(where lbq.Where, parentField string, fields map[string]*Field) (
 	return query, nil
 }
 
+// isNestedOperator tells whether a key below a field is an operator. The keys named like the operators that are
+// also common field names, like type or size, can be fields when the parent is a sub-document: they are fields when
+// the parent, or the elements of an array parent, declare them, or when the value does not have the shape of the
+// operator.
+func isNestedOperator(key string, val interface{}, parentField string, fields map[string]*Field) bool {
+	if !fieldNamedOperators[key] {
+		return true
+	}
+
+	if parent, _, exists := getSubField(parentField, fields); exists {
+		if _, isElementField := parent.ElementFields[key]; isElementField {
+			return false
+		}
+		// A path below the known fields has no type, it is checked by the shape of the value
+		if parent.IndirectFieldType != nil && !isSubDocument(parent) {
+			return true
+		}
+		if hasSubField(parent, key) {
+			return false
+		}
+	}
+
+	val = unwrapEq(val)
+	switch key {
+	case "type":
+		return validateBsonType(val) == nil
+	case "mod", "between":
+		arr, ok := toInterfaceSlice(val)
+		return ok && len(arr) == 2
+	case "size":
+		_, ok := toFloat64(val)
+		return ok
+	case "all":
+		_, ok := toInterfaceSlice(val)
+		return ok
+	case "regexp":
+		_, _, err := parseRegexp(val)
+		return err == nil
+	case "not", "elemMatch":
+		_, ok := val.(lbq.Where)
+		return ok
+	case "near", "geoWithin", "geoIntersects":
+		return true
+	}
+
+	// search is only an operator at the top level
+	return false
+}
+
+func isSubDocument(field *Field) bool {
+	if field.DataType == DtDate || field.IndirectFieldType == nil {
+		return false
+	}
+
+	switch field.IndirectFieldType.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Interface:
+		return true
+	}
+
+	return false
+}
+
+// hasSubField tells whether the field is a sub-document that declares a field with the given json name.
+func hasSubField(field *Field, name string) bool {
+	fieldType := field.IndirectFieldType
+	if fieldType == nil || fieldType.Kind() != reflect.Struct {
+		return false
+	}
+
+	for i := 0; i < fieldType.NumField(); i++ {
+		structField := fieldType.Field(i)
+		jsonName, _, _ := strings.Cut(structField.Tag.Get("json"), ",")
+		if jsonName == name || (jsonName == "" && structField.Name == name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// coerceValue converts the value to the data type of the field. It returns false when the value can not be
+// converted, and the condition is discarded.
+func coerceValue(field *Field, key string, val interface{}) (interface{}, bool) {
+	if field == nil {
+		return nil, false
+	}
+
+	isArrayOperator := key == "inq" || key == "nin" || key == "all"
+
+	switch field.DataType {
+	case DtObjectID:
+		if isArrayOperator {
+			arr, err := getObjectIdArray(val)
+			return arr, err == nil
+		}
+
+		var oidVal any
+		var err error
+		if field.IsPointer {
+			oidVal, err = getObjectIdOrNil(val)
+		} else {
+			oidVal, err = getObjectId(val)
+		}
+		return oidVal, err == nil
+	case DtDate:
+		if isArrayOperator {
+			arr, err := getDateArray(val)
+			return arr, err == nil
+		}
+
+		var dateVal any
+		var err error
+		if field.IsPointer {
+			dateVal, err = getDateOrNil(val)
+		} else {
+			dateVal, err = getDate(val)
+		}
+		return dateVal, err == nil
+	default:
+		return val, true
+	}
+}
+
+// sameKind tells whether the values can be compared as bounds of a range. Numbers of any type are comparable.
+func sameKind(a interface{}, b interface{}) bool {
+	_, aIsNumber := toFloat64(a)
+	_, bIsNumber := toFloat64(b)
+	if aIsNumber || bIsNumber {
+		return aIsNumber && bIsNumber
+	}
+
+	return reflect.TypeOf(a) == reflect.TypeOf(b)
+}
+
+// parseRegexp splits a /pattern/flags string. The g flag has no meaning in MongoDB and is ignored.
+func parseRegexp(val interface{}) (string, string, error) {
+	if regex, ok := val.(primitive.Regex); ok {
+		return regex.Pattern, regex.Options, nil
+	}
+
+	expression, ok := val.(string)
+	if !ok || expression == "" {
+		return "", "", errors.New("invalid where parameter. regexp must be a string")
+	}
+
+	lastSlash := strings.LastIndex(expression, "/")
+	if !strings.HasPrefix(expression, "/") || lastSlash == 0 {
+		return expression, "", nil
+	}
+
+	pattern := expression[1:lastSlash]
+	regexOptions := ""
+	for _, flag := range expression[lastSlash+1:] {
+		switch flag {
+		case 'g':
+		case 'i', 'm', 's', 'x':
+			if !strings.ContainsRune(regexOptions, flag) {
+				regexOptions += string(flag)
+			}
+		default:
+			return "", "", fmt.Errorf("invalid where parameter. invalid regexp flag %c", flag)
+		}
+	}
+
+	return pattern, regexOptions, nil
+}
+
+var bsonTypeAliases = map[string]bool{
+	"double": true, "string": true, "object": true, "array": true, "binData": true, "undefined": true,
+	"objectId": true, "bool": true, "date": true, "null": true, "regex": true, "dbPointer": true,
+	"javascript": true, "symbol": true, "javascriptWithScope": true, "int": true, "timestamp": true,
+	"long": true, "decimal": true, "minKey": true, "maxKey": true, "number": true,
+}
+
+// validateBsonType accepts a BSON type alias or number, or a list of them.
+func validateBsonType(val interface{}) error {
+	if arr, ok := toInterfaceSlice(val); ok {
+		if len(arr) == 0 {
+			return errors.New("invalid where parameter. type requires at least one type")
+		}
+		for _, el := range arr {
+			if err := validateBsonType(el); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if alias, ok := val.(string); ok {
+		if !bsonTypeAliases[alias] {
+			return fmt.Errorf("invalid where parameter. unknown type %s", alias)
+		}
+		return nil
+	}
+
+	if number, ok := toFloat64(val); ok && number == float64(int64(number)) {
+		return nil
+	}
+
+	return errors.New("invalid where parameter. invalid type")
+}
+
+// getModOperands validates the [divisor, remainder] pair of mod.
+func getModOperands(val interface{}) (bson.A, error) {
+	arr, ok := toInterfaceSlice(val)
+	if !ok || len(arr) != 2 {
+		return nil, errors.New("invalid where parameter. mod requires a divisor and a remainder")
+	}
+
+	divisor, okDivisor := toFloat64(arr[0])
+	remainder, okRemainder := toFloat64(arr[1])
+	if !okDivisor || !okRemainder || divisor == 0 ||
+		divisor != float64(int64(divisor)) || remainder != float64(int64(remainder)) {
+		return nil, errors.New("invalid where parameter. mod operands must be integers and the divisor not zero")
+	}
+
+	return bson.A{int64(divisor), int64(remainder)}, nil
+}
+
+// buildTextSearch translates the search condition, either the terms or
+// {query, language, caseSensitive, diacriticSensitive}, to $text.
+func buildTextSearch(val interface{}) (bson.M, error) {
+	if terms, ok := val.(string); ok {
+		if strings.TrimSpace(terms) == "" {
+			return nil, errors.New("invalid where parameter. search terms are required")
+		}
+		return bson.M{"$search": terms}, nil
+	}
+
+	search, ok := val.(lbq.Where)
+	if !ok {
+		return nil, errors.New("invalid where parameter. invalid search condition")
+	}
+
+	terms, _ := unwrapEq(search["query"]).(string)
+	if strings.TrimSpace(terms) == "" {
+		return nil, errors.New("invalid where parameter. search terms are required")
+	}
+
+	textQuery := bson.M{"$search": terms}
+	if language, ok := search["language"]; ok {
+		languageName, ok := unwrapEq(language).(string)
+		if !ok {
+			return nil, errors.New("invalid where parameter. search language must be a string")
+		}
+		textQuery["$language"] = languageName
+	}
+
+	for key, mongoKey := range map[string]string{"caseSensitive": "$caseSensitive", "diacriticSensitive": "$diacriticSensitive"} {
+		if sensitive, ok := search[key]; ok {
+			sensitiveVal, ok := unwrapEq(sensitive).(bool)
+			if !ok {
+				return nil, fmt.Errorf("invalid where parameter. search %s must be boolean", key)
+			}
+			textQuery[mongoKey] = sensitiveVal
+		}
+	}
+
+	return textQuery, nil
+}
+
+// hasTextSearch checks whether the query, or one of its and conditions, is a text search.
+func hasTextSearch(query bson.M) bool {
+	if _, ok := query["$text"]; ok {
+		return true
+	}
+
+	if conditions, ok := query["$and"].(bson.A); ok {
+		for _, condition := range conditions {
+			if conditionQuery, ok := condition.(bson.M); ok && hasTextSearch(conditionQuery) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// buildElemMatch translates the where of elemMatch. Arrays of sub-documents are matched against the fields of the
+// element, arrays of values against the operators of the array field.
+func buildElemMatch(val interface{}, parentField string, field *Field, fields map[string]*Field, state *whereState) (bson.M, error) {
+	where, ok := val.(lbq.Where)
+	if !ok {
+		return nil, errors.New("invalid where parameter. elemMatch requires a condition")
+	}
+
+	var elemMatch bson.M
+	var err error
+	if field != nil && len(field.ElementFields) > 0 {
+		elemMatch, err = buildWhere(where, "", field.ElementFields, state)
+	} else {
+		elemMatch, err = buildWhere(where, parentField, fields, state)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(elemMatch) == 0 {
+		return nil, errors.New("invalid where parameter. invalid elemMatch condition")
+	}
+
+	return elemMatch, nil
+}
+
+func getArraySize(val interface{}) (int64, error) {
+	size, ok := toFloat64(val)
+	if !ok || size < 0 || size != float64(int64(size)) {
+		return 0, errors.New("invalid where parameter. size must be a positive integer")
+	}
+
+	return int64(size), nil
+}
+
 func getObjectIdArray(val interface{}) ([]primitive.ObjectID, error) {
 	rv := reflect.ValueOf(val)
 	if rv.Kind() == reflect.Slice {
@@ -398,6 +937,28 @@ func getDate(val interface{}) (time.Time, error) {
 	return field, exists, nil
 }*/
 
+// getSubField resolves a dotted path to its field and bson path. The fields of the elements of the arrays of
+// sub-documents are resolved too. The path below the deepest known field, e.g. in a map, is kept as it is, and the
+// field returned has no data type, so its values are not coerced.
+func getSubField(path string, fields map[string]*Field) (*Field, string, bool) {
+	field, exists := getFieldIfExists(path, fields)
+	if !exists {
+		return nil, "", false
+	}
+
+	if field.JsonName == path {
+		return field, field.BsonName, true
+	}
+
+	subPath := path[len(field.JsonName)+1:]
+	if elementField, elementPath, ok := getSubField(subPath, field.ElementFields); ok {
+		return elementField, field.BsonName + "." + elementPath, true
+	}
+
+	bsonPath := field.BsonName + "." + subPath
+	return &Field{JsonName: path, BsonName: bsonPath}, bsonPath, true
+}
+
 func getFieldIfExists(fieldName string, fields map[string]*Field) (*Field, bool) {
 	field, exists := fields[fieldName]
 	if exists {
@@ -6,8 +6,13 @@ import (
 	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type JSONTest struct {
@@ -56,6 +61,333 @@ func TestLbFilterToBson(t *testing.T) {
 	}
 }
 
+// whereToJSON translates the where of the lbq filter and returns it as JSON with sorted keys
+func whereToJSON(model IModel, filter string) (string, error) {
+	lbFilter, err := lbq.ParseFilter(filter)
+	if err != nil {
+		return "", err
+	}
+
+	query, err := lbFilterQuery(*lbFilter, NewSchema(model))
+	if err != nil {
+		return "", err
+	}
+
+	_json, err := json.Marshal(query.Where)
+	return string(_json), err
+}
+
+func TestGeoOperators(t *testing.T) {
+	cases := []struct {
+		filter   string
+		expected string
+	}{
+		{
+			filter:   `{"where": {"geometry": {"near": [-70.6, -33.4], "maxDistance": 500, "minDistance": 10}}}`,
+			expected: `{"geometry":{"$near":{"$geometry":{"coordinates":[-70.6,-33.4],"type":"Point"},"$maxDistance":500,"$minDistance":10}}}`,
+		},
+		{
+			filter:   `{"where": {"geometry": {"geoWithin": {"box": [[-71, -34], [-70, -33]]}}}}`,
+			expected: `{"geometry":{"$geoWithin":{"$geometry":{"coordinates":[[[-71,-34],[-70,-34],[-70,-33],[-71,-33],[-71,-34]]],"type":"Polygon"}}}}`,
+		},
+		{
+			filter:   `{"where": {"geometry": {"geoWithin": {"polygon": [[0, 0], [0, 1], [1, 1], [0, 0]]}}}}`,
+			expected: `{"geometry":{"$geoWithin":{"$geometry":{"coordinates":[[[0,0],[0,1],[1,1],[0,0]]],"type":"Polygon"}}}}`,
+		},
+		{
+			filter:   `{"where": {"geometry": {"geoWithin": {"centerSphere": [[-70.6, -33.4], 0.01]}}}}`,
+			expected: `{"geometry":{"$geoWithin":{"$centerSphere":[[-70.6,-33.4],0.01]}}}`,
+		},
+		{
+			filter:   `{"where": {"geometry": {"geoIntersects": {"type": "Point", "coordinates": [1, 2]}}}}`,
+			expected: `{"geometry":{"$geoIntersects":{"$geometry":{"coordinates":[1,2],"type":"Point"}}}}`,
+		},
+	}
+
+	for _, c := range cases {
+		result, err := whereToJSON(FeatureTest{}, c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result != c.expected {
+			t.Fatalf("expected %s, got %s", c.expected, result)
+		}
+	}
+
+	invalid := []string{
+		`{"where": {"geometry": {"near": [200, 0]}}}`,
+		`{"where": {"geometry": {"near": [1, 2], "maxDistance": -1}}}`,
+		`{"where": {"geometry": {"geoWithin": {"box": [[0, 0]]}}}}`,
+		`{"where": {"geometry": {"geoWithin": {"polygon": [[0, 0], [0, 1], [1, 1], [1, 0]]}}}}`,
+		`{"where": {"geometry": {"geoIntersects": {"type": "Circle", "coordinates": [1, 2]}}}}`,
+		`{"where": {"near": [1, 2]}}`,
+		`{"where": {"geoWithin": {"box": [[0, 0], [1, 1]]}}}`,
+		`{"where": {"or": [{"geoIntersects": {"type": "Point", "coordinates": [1, 2]}}]}}`,
+	}
+
+	for _, filter := range invalid {
+		if _, err := whereToJSON(FeatureTest{}, filter); err == nil {
+			t.Fatalf("expected an error for %s", filter)
+		}
+	}
+}
+
+func TestCountRejectsNear(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client is not connected, so a count that reaches the server fails with ErrClientDisconnected
+	repository := &MongoRepository[FeatureTest]{
+		schema:         NewSchema(FeatureTest{}),
+		collectionName: "Feature",
+		connector:      &MongoConnector{client: client, connected: true, options: &MongoConnectorOpts{Database: "test"}},
+	}
+
+	near := lbq.Where{"geometry": lbq.Where{"near": []interface{}{1.0, 2.0}}}
+	for _, where := range []lbq.Where{near, {"or": lbq.AndOrCondition{near}}} {
+		if _, err := repository.Count(lbq.Filter{Where: where}); err == nil || err == mongo.ErrClientDisconnected {
+			t.Fatalf("near must be rejected by count, got %v", err)
+		}
+	}
+
+	within := lbq.Where{"geometry": lbq.Where{"geoWithin": lbq.Where{"box": []interface{}{
+		[]interface{}{0.0, 0.0}, []interface{}{1.0, 1.0},
+	}}}}
+	if _, err := repository.Count(lbq.Filter{Where: within}); err != mongo.ErrClientDisconnected {
+		t.Fatalf("geoWithin must be accepted by count, got %v", err)
+	}
+}
+
+func TestArrayOperators(t *testing.T) {
+	sensorId := primitive.NewObjectID()
+	cases := []struct {
+		filter   string
+		expected string
+	}{
+		{
+			filter:   `{"where": {"path": {"all": ["a", "b"]}}}`,
+			expected: `{"path":{"$all":["a","b"]}}`,
+		},
+		{
+			filter:   `{"where": {"path": {"size": 2}}}`,
+			expected: `{"path":{"$size":2}}`,
+		},
+		{
+			filter:   `{"where": {"path": {"elemMatch": {"gt": "a", "lt": "c"}}}}`,
+			expected: `{"path":{"$elemMatch":{"$gt":"a","$lt":"c"}}}`,
+		},
+		{
+			filter:   `{"where": {"measurements": {"elemMatch": {"name": "temp", "value": {"gte": 10}, "sensorId": "` + sensorId.Hex() + `"}}}}`,
+			expected: `{"measurements":{"$elemMatch":{"name":{"$eq":"temp"},"sensorId":{"$eq":"` + sensorId.Hex() + `"},"value":{"$gte":10}}}}`,
+		},
+		{
+			filter:   `{"where": {"projectId": {"all": ["` + sensorId.Hex() + `"]}}}`,
+			expected: `{"projectId":{"$all":["` + sensorId.Hex() + `"]}}`,
+		},
+	}
+
+	for _, c := range cases {
+		result, err := whereToJSON(AssetTest{}, c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result != c.expected {
+			t.Fatalf("expected %s, got %s", c.expected, result)
+		}
+	}
+
+	// The ObjectID fields of the elements are coerced
+	lbFilter, _ := lbq.ParseFilter(`{"where": {"measurements": {"elemMatch": {"sensorId": "` + sensorId.Hex() + `"}}}}`)
+	query, err := lbFilterQuery(*lbFilter, NewSchema(AssetTest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elemMatch, _ := query.Where["measurements"].(bson.M)["$elemMatch"].(bson.M)
+	sensorCondition, _ := elemMatch["sensorId"].(bson.M)
+	if oid, ok := sensorCondition["$eq"].(primitive.ObjectID); !ok || oid != sensorId {
+		t.Fatalf("sensorId must be an ObjectID, got %#v", elemMatch)
+	}
+
+	invalid := []string{
+		`{"where": {"path": {"size": -1}}}`,
+		`{"where": {"path": {"size": 1.5}}}`,
+		`{"where": {"measurements": {"elemMatch": {"unknown": 1}}}}`,
+		`{"where": {"path": {"all": "a"}}}`,
+		`{"where": {"path": {"all": {"gt": 1}}}}`,
+	}
+
+	for _, filter := range invalid {
+		if _, err := whereToJSON(AssetTest{}, filter); err == nil {
+			t.Fatalf("expected an error for %s", filter)
+		}
+	}
+}
+
+func TestRangeAndMiscOperators(t *testing.T) {
+	cases := []struct {
+		filter   string
+		expected string
+	}{
+		{
+			filter:   `{"where": {"name": {"between": ["a", "m"]}}}`,
+			expected: `{"name":{"$gte":"a","$lte":"m"}}`,
+		},
+		{
+			filter:   `{"where": {"requested": {"between": ["2022-01-01T00:00:00Z", "2022-02-01T00:00:00Z"]}}}`,
+			expected: `{"requested":{"$gte":"2022-01-01T00:00:00Z","$lte":"2022-02-01T00:00:00Z"}}`,
+		},
+		{
+			filter:   `{"where": {"name": {"regexp": "/^tank/gi"}}}`,
+			expected: `{"name":{"$options":"i","$regex":"^tank"}}`,
+		},
+		{
+			filter:   `{"where": {"name": {"regexp": "^tank"}}}`,
+			expected: `{"name":{"$regex":"^tank"}}`,
+		},
+		{
+			filter:   `{"where": {"name": {"not": {"like": "tank", "options": "i"}}}}`,
+			expected: `{"name":{"$not":{"$options":"i","$regex":"tank"}}}`,
+		},
+		{
+			filter:   `{"where": {"name": {"not": {"inq": ["a", "b"]}}}}`,
+			expected: `{"name":{"$not":{"$in":["a","b"]}}}`,
+		},
+		{
+			filter:   `{"where": {"name": {"not": {"eq": "tank"}}}}`,
+			expected: `{"name":{"$ne":"tank"}}`,
+		},
+		{
+			// lbq wraps the value in an eq
+			filter:   `{"where": {"name": {"not": "tank"}}}`,
+			expected: `{"name":{"$ne":"tank"}}`,
+		},
+		{
+			filter:   `{"where": {"not": {"name": "tank", "icon": {"like": "^pump"}}}}`,
+			expected: `{"$nor":[{"icon":{"$regex":"^pump"},"name":{"$eq":"tank"}}]}`,
+		},
+		{
+			filter:   `{"where": {"name": {"type": "string"}}}`,
+			expected: `{"name":{"$type":"string"}}`,
+		},
+		{
+			filter:   `{"where": {"type": {"type": "string"}}}`,
+			expected: `{"type":{"$type":"string"}}`,
+		},
+		{
+			filter:   `{"where": {"type": "tank"}}`,
+			expected: `{"type":{"$eq":"tank"}}`,
+		},
+		{
+			filter:   `{"where": {"_config.dataTTL": {"mod": [4, 1]}}}`,
+			expected: `{"_config.dataTTL":{"$mod":[4,1]}}`,
+		},
+	}
+
+	for _, c := range cases {
+		result, err := whereToJSON(AssetTest{}, c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result != c.expected {
+			t.Fatalf("expected %s, got %s", c.expected, result)
+		}
+	}
+
+	// Both bounds are coerced to the field type
+	lbFilter, _ := lbq.ParseFilter(`{"where": {"requested": {"between": ["2022-01-01T00:00:00Z", "2022-02-01T00:00:00Z"]}}}`)
+	query, err := lbFilterQuery(*lbFilter, NewSchema(AssetTest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	requested, _ := query.Where["requested"].(bson.M)
+	if _, ok := requested["$gte"].(*time.Time); !ok {
+		t.Fatalf("the lower bound must be a date, got %#v", requested["$gte"])
+	}
+	if _, ok := requested["$lte"].(*time.Time); !ok {
+		t.Fatalf("the upper bound must be a date, got %#v", requested["$lte"])
+	}
+
+	invalid := []string{
+		`{"where": {"name": {"between": ["a"]}}}`,
+		`{"where": {"projectId": {"between": ["a", "b"]}}}`,
+		`{"where": {"name": {"regexp": "/^tank/z"}}}`,
+		`{"where": {"name": {"between": [null, "b"]}}}`,
+		`{"where": {"requested": {"between": [null, "2022-02-01T00:00:00Z"]}}}`,
+		`{"where": {"name": {"between": [1, "b"]}}}`,
+		`{"where": {"name": {"not": {"icon": "tank"}}}}`,
+		`{"where": {"name": {"type": "text"}}}`,
+		`{"where": {"name": {"mod": [0, 1]}}}`,
+	}
+
+	for _, filter := range invalid {
+		if _, err := whereToJSON(AssetTest{}, filter); err == nil {
+			t.Fatalf("expected an error for %s", filter)
+		}
+	}
+}
+
+func TestTextSearch(t *testing.T) {
+	cases := []struct {
+		filter   string
+		expected string
+	}{
+		{
+			filter:   `{"where": {"search": "water tank"}}`,
+			expected: `{"$text":{"$search":"water tank"}}`,
+		},
+		{
+			filter:   `{"where": {"search": {"query": "estanque", "language": "es", "caseSensitive": false}, "type": "tank"}}`,
+			expected: `{"$text":{"$caseSensitive":false,"$language":"es","$search":"estanque"},"type":{"$eq":"tank"}}`,
+		},
+	}
+
+	for _, c := range cases {
+		result, err := whereToJSON(AssetTest{}, c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result != c.expected {
+			t.Fatalf("expected %s, got %s", c.expected, result)
+		}
+	}
+
+	lbFilter, _ := lbq.ParseFilter(`{"where": {"search": "tank"}, "order": "textScore DESC", "fields": ["name"]}`)
+	query, err := lbFilterQuery(*lbFilter, NewSchema(AssetTest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_json, _ := json.Marshal(query.Options.projection())
+	if string(_json) != `{"name":true,"textScore":{"$meta":"textScore"}}` {
+		t.Fatalf("invalid projection %s", _json)
+	}
+
+	_json, _ = json.Marshal(query.Options.Sort)
+	if string(_json) != `[{"Key":"textScore","Value":{"$meta":"textScore"}}]` {
+		t.Fatalf("invalid sort %s", _json)
+	}
+
+	invalid := []string{
+		`{"where": {"search": ""}}`,
+		`{"where": {"name": {"search": "tank"}}}`,
+		`{"where": {"name": "tank"}, "order": "textScore DESC"}`,
+	}
+
+	for _, filter := range invalid {
+		lbFilter, _ := lbq.ParseFilter(filter)
+		if _, err := lbFilterQuery(*lbFilter, NewSchema(AssetTest{})); err == nil {
+			t.Fatalf("expected an error for %s", filter)
+		}
+	}
+}
+
 func BenchmarkLbFilterToBson(b *testing.B) {
 	repository, _ := NewRepository[AssetTest](nil, RepositoryOptions{Created: true, Modified: true, Deleted: true})
 	var filters []lbq.Filter
@@ -75,3 +407,112 @@ func BenchmarkLbFilterToBson(b *testing.B) {
 		})
 	}
 }
+
+func TestNestedFieldsNamedLikeOperators(t *testing.T) {
+	cases := []struct {
+		filter   string
+		expected string
+	}{
+		{
+			filter:   `{"where": {"properties": {"type": "x"}}}`,
+			expected: `{"properties":{"type":{"$eq":"x"}}}`,
+		},
+		{
+			filter:   `{"where": {"properties": {"type": "string"}}}`,
+			expected: `{"properties":{"$type":"string"}}`,
+		},
+		{
+			// The geometry declares a type field
+			filter:   `{"where": {"geometry": {"type": "string"}}}`,
+			expected: `{"geometry":{"type":{"$eq":"string"}}}`,
+		},
+	}
+
+	for _, c := range cases {
+		_json, err := whereToJSON(FeatureTest{}, c.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", c.filter, err)
+		}
+		if _json != c.expected {
+			t.Fatalf("%s: expected %s, got %s", c.filter, c.expected, _json)
+		}
+	}
+
+	_json, err := whereToJSON(AssetTest{}, `{"where": {"measurements": {"size": 2}}}`)
+	if err != nil || _json != `{"measurements":{"$size":2}}` {
+		t.Fatalf("size must be an operator of the arrays, got %s, %v", _json, err)
+	}
+
+	// The sub-documents of ZoneTest declare a type field, the model does not
+	zoneCases := []struct {
+		filter   string
+		expected string
+	}{
+		{
+			// A field, not $type, and like the other nested keys it is not a field of the model
+			filter:   `{"where": {"name": "a", "area": {"type": "Point"}}}`,
+			expected: `{"name":{"$eq":"a"}}`,
+		},
+		{
+			filter:   `{"where": {"area.type": {"inq": ["Point", "Polygon"]}}}`,
+			expected: `{"area.type":{"$in":["Point","Polygon"]}}`,
+		},
+		{
+			filter:   `{"where": {"metadata": {"type": "object"}}}`,
+			expected: `{"metadata":{"$type":"object"}}`,
+		},
+	}
+
+	for _, c := range zoneCases {
+		_json, err := whereToJSON(ZoneTest{}, c.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", c.filter, err)
+		}
+		if _json != c.expected {
+			t.Fatalf("%s: expected %s, got %s", c.filter, c.expected, _json)
+		}
+	}
+}
+
+func TestDottedPathsResolveTheLeafField(t *testing.T) {
+	// The fields of the elements of an array are coerced to their own type
+	sensorId := primitive.NewObjectID()
+	lbFilter, _ := lbq.ParseFilter(fmt.Sprintf(`{"where": {"sensors.sensorId": "%s"}}`, sensorId.Hex()))
+	query, err := lbFilterQuery(*lbFilter, NewSchema(ZoneTest{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition, _ := query.Where["sensors.sensorId"].(bson.M)
+	if condition["$eq"] != sensorId {
+		t.Fatalf("the element field must be coerced to an ObjectID, got %#v", query.Where)
+	}
+
+	// A path below a known field has no type, so it is not coerced with the type of that field
+	cases := []struct {
+		filter   string
+		expected string
+	}{
+		{
+			filter:   fmt.Sprintf(`{"where": {"assetId.ref": "%s"}}`, sensorId.Hex()),
+			expected: fmt.Sprintf(`{"assetId.ref":{"$eq":"%s"}}`, sensorId.Hex()),
+		},
+		{
+			filter:   `{"where": {"requested.source": "2022-02-01T00:00:00Z"}}`,
+			expected: `{"requested.source":{"$eq":"2022-02-01T00:00:00Z"}}`,
+		},
+		{
+			filter:   `{"where": {"measurements.0.name": "a"}}`,
+			expected: `{"measurements.0.name":{"$eq":"a"}}`,
+		},
+	}
+
+	for _, c := range cases {
+		_json, err := whereToJSON(AssetTest{}, c.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", c.filter, err)
+		}
+		if _json != c.expected {
+			t.Fatalf("%s: expected %s, got %s", c.filter, c.expected, _json)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package go_mongo_repository
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var geoJSONTypes = map[string]bool{
+	"Point":           true,
+	"MultiPoint":      true,
+	"LineString":      true,
+	"MultiLineString": true,
+	"Polygon":         true,
+	"MultiPolygon":    true,
+}
+
+// buildNear translates {near: [lng, lat], maxDistance: m, minDistance: m} to $near over a GeoJSON point.
+// The distances are in meters.
+func buildNear(near interface{}, maxDistance interface{}, minDistance interface{}) (bson.M, error) {
+	point, err := getGeoPoint(near)
+	if err != nil {
+		return nil, err
+	}
+
+	query := bson.M{
+		"$geometry": bson.M{"type": "Point", "coordinates": point},
+	}
+
+	if maxDistance != nil {
+		distance, err := getGeoDistance(maxDistance)
+		if err != nil {
+			return nil, err
+		}
+		query["$maxDistance"] = distance
+	}
+
+	if minDistance != nil {
+		distance, err := getGeoDistance(minDistance)
+		if err != nil {
+			return nil, err
+		}
+		query["$minDistance"] = distance
+	}
+
+	return query, nil
+}
+
+// buildGeoWithin translates {box: [[lng, lat], [lng, lat]]}, {polygon: [[lng, lat], ...]} or
+// {centerSphere: [[lng, lat], radians]} to the $geoWithin shape. The box is a GeoJSON polygon, whose edges are
+// great circle arcs instead of lines of constant latitude, so a wide box does not match the area of the legacy $box.
+func buildGeoWithin(geoWithin interface{}) (bson.M, error) {
+	shape, ok := unwrapEq(geoWithin).(lbq.Where)
+	if !ok || len(shape) != 1 {
+		return nil, errors.New("invalid where parameter. geoWithin requires one of box, polygon or centerSphere")
+	}
+
+	for key, val := range shape {
+		switch key {
+		case "box":
+			corners, err := getGeoPoints(val)
+			if err != nil {
+				return nil, err
+			}
+			if len(corners) != 2 {
+				return nil, errors.New("invalid where parameter. box requires two corners")
+			}
+			return bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": bson.A{boxRing(corners)}}}, nil
+		case "polygon":
+			ring, err := getGeoRing(val)
+			if err != nil {
+				return nil, err
+			}
+			return bson.M{"$geometry": bson.M{"type": "Polygon", "coordinates": bson.A{ring}}}, nil
+		case "centerSphere":
+			arr, ok := toInterfaceSlice(unwrapEq(val))
+			if !ok || len(arr) != 2 {
+				return nil, errors.New("invalid where parameter. centerSphere requires a center and a radius")
+			}
+			center, err := getGeoPoint(arr[0])
+			if err != nil {
+				return nil, err
+			}
+			radius, err := getGeoDistance(arr[1])
+			if err != nil {
+				return nil, err
+			}
+			return bson.M{"$centerSphere": bson.A{center, radius}}, nil
+		}
+	}
+
+	return nil, errors.New("invalid where parameter. geoWithin requires one of box, polygon or centerSphere")
+}
+
+// buildGeoIntersects translates a GeoJSON geometry {type, coordinates} to $geoIntersects.
+func buildGeoIntersects(geoIntersects interface{}) (bson.M, error) {
+	geometry, ok := unwrapEq(geoIntersects).(lbq.Where)
+	if !ok {
+		return nil, errors.New("invalid where parameter. geoIntersects requires a GeoJSON geometry")
+	}
+
+	geoType, _ := unwrapEq(geometry["type"]).(string)
+	if !geoJSONTypes[geoType] {
+		return nil, fmt.Errorf("invalid where parameter. unsupported GeoJSON type %v", geometry["type"])
+	}
+
+	coordinates := unwrapEq(geometry["coordinates"])
+	var err error
+	switch geoType {
+	case "Point":
+		coordinates, err = getGeoPoint(coordinates)
+	case "LineString", "MultiPoint":
+		coordinates, err = getGeoPoints(coordinates)
+	case "Polygon":
+		rings, ok := toInterfaceSlice(coordinates)
+		if !ok || len(rings) == 0 {
+			return nil, errors.New("invalid where parameter. invalid polygon coordinates")
+		}
+		polygon := bson.A{}
+		for _, ring := range rings {
+			closedRing, err := getGeoRing(ring)
+			if err != nil {
+				return nil, err
+			}
+			polygon = append(polygon, closedRing)
+		}
+		coordinates = polygon
+	default:
+		if _, ok := toInterfaceSlice(coordinates); !ok {
+			err = errors.New("invalid where parameter. invalid GeoJSON coordinates")
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.M{"$geometry": bson.M{"type": geoType, "coordinates": coordinates}}, nil
+}
+
+// getGeoPoint validates a [lng, lat] pair. A GeoJSON point is accepted as well.
+func getGeoPoint(val interface{}) (bson.A, error) {
+	val = unwrapEq(val)
+	if geometry, ok := val.(lbq.Where); ok {
+		if geoType, _ := unwrapEq(geometry["type"]).(string); geoType != "Point" {
+			return nil, errors.New("invalid where parameter. expected a GeoJSON point")
+		}
+		val = unwrapEq(geometry["coordinates"])
+	}
+
+	arr, ok := toInterfaceSlice(val)
+	if !ok || len(arr) != 2 {
+		return nil, errors.New("invalid where parameter. a point must be [longitude, latitude]")
+	}
+
+	lng, okLng := toFloat64(arr[0])
+	lat, okLat := toFloat64(arr[1])
+	if !okLng || !okLat {
+		return nil, errors.New("invalid where parameter. coordinates must be numbers")
+	}
+
+	if lng < -180 || lng > 180 || lat < -90 || lat > 90 {
+		return nil, fmt.Errorf("invalid where parameter. coordinates [%v, %v] out of range", lng, lat)
+	}
+
+	return bson.A{lng, lat}, nil
+}
+
+func getGeoPoints(val interface{}) (bson.A, error) {
+	arr, ok := toInterfaceSlice(unwrapEq(val))
+	if !ok || len(arr) == 0 {
+		return nil, errors.New("invalid where parameter. expected a list of points")
+	}
+
+	points := bson.A{}
+	for _, el := range arr {
+		point, err := getGeoPoint(el)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, point)
+	}
+
+	return points, nil
+}
+
+// getGeoRing validates a closed linear ring of at least four points.
+func getGeoRing(val interface{}) (bson.A, error) {
+	points, err := getGeoPoints(val)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(points) < 4 {
+		return nil, errors.New("invalid where parameter. a polygon requires at least four points")
+	}
+
+	first := points[0].(bson.A)
+	last := points[len(points)-1].(bson.A)
+	if first[0] != last[0] || first[1] != last[1] {
+		return nil, errors.New("invalid where parameter. a polygon must be closed")
+	}
+
+	return points, nil
+}
+
+// boxRing returns the closed ring of the box with the given opposite corners, counterclockwise from the first one.
+// The legacy $box works on flat coordinates and is not supported by the 2dsphere indexes.
+func boxRing(corners bson.A) bson.A {
+	first := corners[0].(bson.A)
+	second := corners[1].(bson.A)
+
+	return bson.A{
+		first,
+		bson.A{second[0], first[1]},
+		second,
+		bson.A{first[0], second[1]},
+		first,
+	}
+}
+
+func getGeoDistance(val interface{}) (float64, error) {
+	distance, ok := toFloat64(unwrapEq(val))
+	if !ok || distance < 0 {
+		return 0, errors.New("invalid where parameter. distances must be non-negative numbers")
+	}
+
+	return distance, nil
+}
+
+// unwrapEq returns the value of an {eq: value} condition. lbq wraps the values of unknown operators that way.
+func unwrapEq(val interface{}) interface{} {
+	if where, ok := val.(lbq.Where); ok && len(where) == 1 {
+		if eq, ok := where["eq"]; ok {
+			return eq
+		}
+	}
+
+	return val
+}
+
+func toInterfaceSlice(val interface{}) ([]interface{}, bool) {
+	if arr, ok := val.([]interface{}); ok {
+		return arr, true
+	}
+
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+
+	arr := make([]interface{}, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		arr[i] = rv.Index(i).Interface()
+	}
+	return arr, true
+}
+
+func toFloat64(val interface{}) (float64, bool) {
+	rv := reflect.ValueOf(val)
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(rv.Uint()), true
+	default:
+		return 0, false
+	}
+}
+
+// hasNear reports whether the query has a $near condition, which sorts the results and is not supported by
+// CountDocuments.
+func hasNear(query interface{}) bool {
+	switch v := query.(type) {
+	case bson.M:
+		for key, val := range v {
+			if key == "$near" || hasNear(val) {
+				return true
+			}
+		}
+	case bson.A:
+		return hasNear([]interface{}(v))
+	case []interface{}:
+		for _, el := range v {
+			if hasNear(el) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package go_mongo_repository
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type RegexMode string
+
+const (
+	RegexModeRaw     RegexMode = ""        // The like values are used as regular expressions
+	RegexModeLiteral RegexMode = "literal" // The like values match a substring, the metacharacters are escaped
+	RegexModePrefix  RegexMode = "prefix"  // The like values match a prefix, which can use an index
+)
+
+// RegexPolicy restricts the regular expressions of the like, nlike and regexp conditions.
+type RegexPolicy struct {
+	Mode            RegexMode // Applies to like and nlike, regexp is always a regular expression
+	MaxLength       int       // Maximum pattern length, before escaping. 0 means no limit
+	AllowedOptions  string    // Allowed option flags. Defaults to "imsx"
+	RejectUntrusted bool      // Reject the regular expressions of the filters that are not trusted
+}
+
+// FilterPolicy restricts the filters received by the repository. Filters are untrusted unless the call is made with
+// QueryOptions.Trusted, trusted filters are built by the application and are not restricted. The zero values
+// disable each limit.
+type FilterPolicy struct {
+	Regex RegexPolicy
+
+	DefaultLimit     int64    // Limit of the filters without one
+	MaxLimit         int64    // Filters with a greater limit are rejected
+	MaxSkip          int64    // Filters with a greater skip are rejected
+	MaxArraySize     int      // Maximum values of and, or, inq, nin and all
+	MaxDepth         int      // Maximum nesting of the where, the top level is 1
+	FilterableFields []string // Fields allowed in the where. Sub-fields of an allowed field are allowed too
+	SortableFields   []string // Fields allowed in the order, besides the text score
+	RequireIndex     bool     // Find, FindOne and Count are rejected when their plan scans the collection
+}
+
+// ErrCollectionScan is returned when RequireIndex is set and the query does not use an index.
+var ErrCollectionScan = errors.New("the query does not use an index")
+
+// checkFilter validates the filter against the limits of the policy, before it is translated.
+func (policy *FilterPolicy) checkFilter(filter lbq.Filter, fields map[string]*Field) error {
+	if policy == nil {
+		return nil
+	}
+
+	if policy.MaxLimit > 0 && filter.Limit > policy.MaxLimit {
+		return fmt.Errorf("invalid limit parameter. the maximum limit is %d", policy.MaxLimit)
+	}
+
+	if policy.MaxSkip > 0 && filter.Skip > policy.MaxSkip {
+		return fmt.Errorf("invalid skip parameter. the maximum skip is %d", policy.MaxSkip)
+	}
+
+	if len(policy.SortableFields) > 0 {
+		for _, order := range filter.Order {
+			if order.Field != TextScoreField && !isAllowedField(order.Field, policy.SortableFields) {
+				return fmt.Errorf("invalid order parameter. %s is not sortable", order.Field)
+			}
+		}
+	}
+
+	return policy.checkWhere(filter.Where, 1, "", fields)
+}
+
+// checkWhere validates the where below the parent field, the top level when it is empty. The keys are classified as
+// fields or operators with the same rules as buildWhere.
+func (policy *FilterPolicy) checkWhere(where lbq.Where, depth int, parentField string, fields map[string]*Field) error {
+	if len(where) == 0 {
+		return nil
+	}
+
+	if policy.MaxDepth > 0 && depth > policy.MaxDepth {
+		return fmt.Errorf("invalid where parameter. the maximum depth is %d", policy.MaxDepth)
+	}
+
+	for key, val := range where {
+		_, isOperator := operators[key]
+		if isOperator && parentField == "" && fieldNamedOperators[key] {
+			if _, isField := fields[key]; isField {
+				isOperator = false
+			}
+		} else if isOperator && parentField != "" && !isNestedOperator(key, val, parentField, fields) {
+			isOperator = false
+		}
+
+		switch {
+		case key == "and" || key == "or":
+			conditions, _ := val.(lbq.AndOrCondition)
+			if err := policy.checkArraySize(key, len(conditions)); err != nil {
+				return err
+			}
+			for _, condition := range conditions {
+				if err := policy.checkWhere(condition, depth+1, parentField, fields); err != nil {
+					return err
+				}
+			}
+		case isOperator && key == "not" && parentField == "":
+			// A top level not has the conditions of the fields it negates
+			if nested, ok := val.(lbq.Where); ok {
+				if err := policy.checkWhere(nested, depth+1, "", fields); err != nil {
+					return err
+				}
+			}
+		case isOperator && (key == "inq" || key == "nin" || key == "all"):
+			if values, ok := toInterfaceSlice(unwrapEq(val)); ok {
+				if err := policy.checkArraySize(key, len(values)); err != nil {
+					return err
+				}
+			}
+		case isOperator:
+			// The conditions of not and elemMatch are nested in the field they apply to
+			if nested, ok := unwrapEq(val).(lbq.Where); ok {
+				if err := policy.checkDepth(nested, depth+1); err != nil {
+					return err
+				}
+			}
+		case strings.HasPrefix(key, "$") || likeKeys[key]:
+		default:
+			if len(policy.FilterableFields) > 0 && !isAllowedField(key, policy.FilterableFields) {
+				return fmt.Errorf("invalid where parameter. %s is not filterable", key)
+			}
+			if nested, ok := val.(lbq.Where); ok {
+				if err := policy.checkWhere(nested, depth+1, key, fields); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkDepth validates the nesting of a condition whose keys are not checked against the filterable fields.
+func (policy *FilterPolicy) checkDepth(where lbq.Where, depth int) error {
+	if policy.MaxDepth > 0 && depth > policy.MaxDepth {
+		return fmt.Errorf("invalid where parameter. the maximum depth is %d", policy.MaxDepth)
+	}
+
+	for _, val := range where {
+		switch v := val.(type) {
+		case lbq.Where:
+			if err := policy.checkDepth(v, depth+1); err != nil {
+				return err
+			}
+		case lbq.AndOrCondition:
+			if err := policy.checkArraySize("and/or", len(v)); err != nil {
+				return err
+			}
+			for _, condition := range v {
+				if err := policy.checkDepth(condition, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (policy *FilterPolicy) checkArraySize(key string, size int) error {
+	if policy.MaxArraySize > 0 && size > policy.MaxArraySize {
+		return fmt.Errorf("invalid where parameter. %s accepts up to %d values", key, policy.MaxArraySize)
+	}
+
+	return nil
+}
+
+// likeKeys are the keys of the conditions that lbq keeps as they are.
+var likeKeys = map[string]bool{
+	"like": true, "nlike": true, "options": true, "maxDistance": true, "minDistance": true,
+}
+
+// isAllowedField reports whether the field, or one of its parents, is in the list.
+func isAllowedField(name string, allowed []string) bool {
+	for {
+		for _, allowedName := range allowed {
+			if allowedName == name {
+				return true
+			}
+		}
+
+		lastDotIndex := strings.LastIndex(name, ".")
+		if lastDotIndex == -1 {
+			return false
+		}
+		name = name[0:lastDotIndex]
+	}
+}
+
+// usesIndex walks an explained plan and reports whether it has no collection scan.
+func usesIndex(plan bson.M) bool {
+	if stage, _ := plan["stage"].(string); stage == "COLLSCAN" {
+		return false
+	}
+
+	if inputStage, ok := plan["inputStage"].(bson.M); ok && !usesIndex(inputStage) {
+		return false
+	}
+
+	if inputStages, ok := plan["inputStages"].(bson.A); ok {
+		for _, inputStage := range inputStages {
+			if stage, ok := inputStage.(bson.M); ok && !usesIndex(stage) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// like returns the pattern and options of a like or nlike condition according to the policy.
+func (policy *FilterPolicy) like(pattern interface{}, regexOptions interface{}) (interface{}, interface{}, error) {
+	if policy == nil {
+		return pattern, regexOptions, nil
+	}
+
+	patternString, ok := pattern.(string)
+	if !ok {
+		return nil, nil, errors.New("invalid where parameter. like must be a string")
+	}
+
+	if err := policy.checkRegex(patternString, regexOptions); err != nil {
+		return nil, nil, err
+	}
+
+	switch policy.Regex.Mode {
+	case RegexModeLiteral:
+		patternString = regexp.QuoteMeta(patternString)
+	case RegexModePrefix:
+		patternString = "^" + regexp.QuoteMeta(patternString)
+	}
+
+	return patternString, regexOptions, nil
+}
+
+// checkRegex validates a pattern and its options.
+func (policy *FilterPolicy) checkRegex(pattern string, regexOptions interface{}) error {
+	if policy == nil {
+		return nil
+	}
+
+	if policy.Regex.RejectUntrusted {
+		return errors.New("invalid where parameter. regular expressions are not allowed")
+	}
+
+	if policy.Regex.MaxLength > 0 && len(pattern) > policy.Regex.MaxLength {
+		return fmt.Errorf("invalid where parameter. the pattern exceeds %d characters", policy.Regex.MaxLength)
+	}
+
+	if regexOptions == nil {
+		return nil
+	}
+
+	optionsString, ok := regexOptions.(string)
+	if !ok {
+		return errors.New("invalid where parameter. options must be a string")
+	}
+
+	allowedOptions := policy.Regex.AllowedOptions
+	if allowedOptions == "" {
+		allowedOptions = "imsx"
+	}
+
+	for _, flag := range optionsString {
+		if !strings.ContainsRune(allowedOptions, flag) {
+			return fmt.Errorf("invalid where parameter. regex option %c is not allowed", flag)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestRegexPolicy(t *testing.T) {
+	cases := []struct {
+		policy   RegexPolicy
+		filter   string
+		expected string // Empty when the filter must be rejected
+	}{
+		{
+			policy:   RegexPolicy{Mode: RegexModeLiteral},
+			filter:   `{"where": {"name": {"like": ".*(a+)+$", "options": "i"}}}`,
+			expected: `{"name":{"$options":"i","$regex":"\\.\\*\\(a\\+\\)\\+\\$"}}`,
+		},
+		{
+			policy:   RegexPolicy{Mode: RegexModePrefix},
+			filter:   `{"where": {"name": {"nlike": "tank.1"}}}`,
+			expected: `{"name":{"$not":{"$regex":"^tank\\.1"}}}`,
+		},
+		{
+			policy:   RegexPolicy{},
+			filter:   `{"where": {"name": {"like": "^tank"}}}`,
+			expected: `{"name":{"$regex":"^tank"}}`,
+		},
+		{
+			policy: RegexPolicy{MaxLength: 5},
+			filter: `{"where": {"name": {"like": "tank-01"}}}`,
+		},
+		{
+			policy: RegexPolicy{AllowedOptions: "i"},
+			filter: `{"where": {"name": {"like": "tank", "options": "is"}}}`,
+		},
+		{
+			policy: RegexPolicy{AllowedOptions: "i"},
+			filter: `{"where": {"name": {"regexp": "/tank/m"}}}`,
+		},
+		{
+			policy: RegexPolicy{RejectUntrusted: true},
+			filter: `{"where": {"name": {"regexp": "^tank"}}}`,
+		},
+		{
+			policy: RegexPolicy{RejectUntrusted: true},
+			filter: `{"where": {"or": [{"name": {"like": "tank"}}, {"description": "tank"}]}}`,
+		},
+	}
+
+	schema := NewSchema(AssetTest{})
+	for _, c := range cases {
+		lbFilter, err := lbq.ParseFilter(c.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		query, err := lbFilterQueryWithPolicy(*lbFilter, schema, &FilterPolicy{Regex: c.policy})
+		if c.expected == "" {
+			if err == nil {
+				t.Fatalf("the filter %s must be rejected", c.filter)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %v", c.filter, err)
+		}
+
+		_json, _ := json.Marshal(query.Where)
+		if string(_json) != c.expected {
+			t.Fatalf("%s: expected %s, got %s", c.filter, c.expected, _json)
+		}
+	}
+
+	// Trusted filters are not restricted
+	repository := &MongoRepository[AssetTest]{
+		schema:  schema,
+		Options: RepositoryOptions{FilterPolicy: &FilterPolicy{Regex: RegexPolicy{RejectUntrusted: true}}},
+	}
+	filter := lbq.Filter{Where: lbq.Where{"name": lbq.Where{"like": "tank"}}}
+	if _, err := repository.parseFilter(filter, repository.queryOptions(nil)); err == nil {
+		t.Fatal("the untrusted filter must be rejected")
+	}
+	if _, err := repository.parseFilter(filter, repository.queryOptions([]*QueryOptions{NewQueryOptions().SetTrusted(true)})); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterPolicyLimits(t *testing.T) {
+	policy := &FilterPolicy{
+		DefaultLimit:     20,
+		MaxLimit:         100,
+		MaxSkip:          1000,
+		MaxArraySize:     3,
+		MaxDepth:         3,
+		FilterableFields: []string{"name", "type", "measurements"},
+		SortableFields:   []string{"name"},
+	}
+
+	rejected := []string{
+		`{"limit": 500}`,
+		`{"skip": 5000}`,
+		`{"where": {"name": {"inq": ["a", "b", "c", "d"]}}}`,
+		`{"where": {"or": [{"name": "a"}, {"name": "b"}, {"name": "c"}, {"name": "d"}]}}`,
+		`{"where": {"or": [{"and": [{"name": {"neq": "a"}}]}]}}`,
+		`{"where": {"description": "tank"}}`,
+		`{"where": {"or": [{"name": "a"}, {"description": "b"}]}}`,
+		`{"where": {"not": {"description": "tank"}}}`,
+		`{"order": "description ASC"}`,
+	}
+
+	schema := NewSchema(AssetTest{})
+	for _, filter := range rejected {
+		lbFilter, err := lbq.ParseFilter(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := lbFilterQueryWithPolicy(*lbFilter, schema, policy); err == nil {
+			t.Fatalf("the filter %s must be rejected", filter)
+		}
+	}
+
+	accepted := []string{
+		`{"where": {"name": {"inq": ["a", "b", "c"]}}, "order": "name DESC"}`,
+		`{"where": {"type": "tank", "measurements.value": {"gt": 1}}}`,
+		`{"where": {"or": [{"name": "a"}, {"name": {"neq": "b"}}]}}`,
+		`{"where": {"measurements": {"name": "a"}, "not": {"name": "b"}}}`,
+	}
+
+	for _, filter := range accepted {
+		lbFilter, err := lbq.ParseFilter(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		query, err := lbFilterQueryWithPolicy(*lbFilter, schema, policy)
+		if err != nil {
+			t.Fatalf("%s: %v", filter, err)
+		}
+
+		if query.Options.Limit == nil || *query.Options.Limit != 20 {
+			t.Fatalf("%s: the default limit must be applied", filter)
+		}
+	}
+}
+
+func TestUsesIndex(t *testing.T) {
+	indexScan := bson.M{"stage": "FETCH", "inputStage": bson.M{"stage": "IXSCAN"}}
+	if !usesIndex(indexScan) {
+		t.Fatal("the plan uses an index")
+	}
+
+	orPlan := bson.M{"stage": "SUBPLAN", "inputStage": bson.M{
+		"stage":       "OR",
+		"inputStages": bson.A{bson.M{"stage": "IXSCAN"}, bson.M{"stage": "COLLSCAN"}},
+	}}
+	if usesIndex(orPlan) {
+		t.Fatal("the plan scans the collection")
+	}
+}
+
+func TestFilterPolicyInternalFilters(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instrumentation := &recordingInstrumentation{}
+	datasource := &MongoDatasource{}
+	datasource.AddInstrumentation(instrumentation)
+
+	// The client is not connected, so the calls that pass the policy fail with ErrClientDisconnected
+	repository := &MongoRepository[AssetTest]{
+		schema:         NewSchema(AssetTest{}),
+		collectionName: "Asset",
+		datasource:     datasource,
+		connector:      &MongoConnector{client: client, connected: true, options: &MongoConnectorOpts{Database: "test"}},
+		Options: RepositoryOptions{FilterPolicy: &FilterPolicy{
+			FilterableFields: []string{"name"},
+			DefaultLimit:     1,
+			MaxArraySize:     1,
+			MaxDepth:         1,
+		}},
+	}
+
+	id := primitive.NewObjectID()
+	if _, err := repository.FindById(id, lbq.Filter{}); err != mongo.ErrClientDisconnected {
+		t.Fatalf("FindById: the id must not be checked by the policy, got %v", err)
+	}
+	if err := repository.UpdateById(id, bson.M{"name": "tank"}); err != mongo.ErrClientDisconnected {
+		t.Fatalf("UpdateById: the id must not be checked by the policy, got %v", err)
+	}
+
+	filter := lbq.Filter{Where: lbq.Where{"name": "tank"}}
+	if _, err := repository.FindById(id, filter); err != mongo.ErrClientDisconnected {
+		t.Fatalf("FindById: the allowed where of the caller must be accepted, got %v", err)
+	}
+	if instrumentation.ended[2].Filter != `{"$and":[{"_id":"?"},{"name":"?"}]}` {
+		t.Fatalf("invalid filter shape %s", instrumentation.ended[2].Filter)
+	}
+
+	filter = lbq.Filter{Where: lbq.Where{"description": "tank"}}
+	if _, err := repository.FindById(id, filter); err == nil || err == mongo.ErrClientDisconnected {
+		t.Fatalf("FindById: the where of the caller must be checked by the policy, got %v", err)
+	}
+
+	loader := NewLoader(repository, LoaderOptions{})
+	ids := []interface{}{primitive.NewObjectID(), primitive.NewObjectID()}
+	if _, errs := loader.LoadMany(context.Background(), ids); errs[0] != mongo.ErrClientDisconnected {
+		t.Fatalf("Loader: the batch must not be checked by the policy, got %v", errs[0])
+	}
+
+	last := instrumentation.ended[len(instrumentation.ended)-1]
+	if last.Name != "Find" || last.Limit != 0 {
+		t.Fatalf("Loader: the default limit must not be applied, got %+v", last)
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/simplereach/timeutils v1.2.0
 	github.com/xompass/lbq v0.0.0
 	go.mongodb.org/mongo-driver v1.10.1
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -27,5 +28,4 @@ require (
 	golang.org/x/text v0.3.7 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
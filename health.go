@@ -0,0 +1,390 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrShuttingDown is returned by the repository operations started after Shutdown or Destroy.
+var ErrShuttingDown = errors.New("the datasource is shutting down")
+
+type Topology string
+
+const (
+	TopologyStandalone Topology = "standalone"
+	TopologyReplicaSet Topology = "replicaSet"
+	TopologySharded    Topology = "sharded"
+	TopologyUnknown    Topology = "unknown"
+)
+
+// ConnectorHealth is the result of a health check of a connector.
+type ConnectorHealth struct {
+	Name       string        `json:"name"`
+	Healthy    bool          `json:"healthy"`
+	Connected  bool          `json:"connected"` // False for a lazy connector that was not used, it is not checked
+	Latency    time.Duration `json:"latency"`
+	Topology   Topology      `json:"topology"`
+	ReplicaSet string        `json:"replicaSet,omitempty"`
+	Primary    string        `json:"primary,omitempty"`
+	Circuit    CircuitState  `json:"circuit"`
+	Error      string        `json:"error,omitempty"`
+	CheckedAt  time.Time     `json:"checkedAt"`
+}
+
+// HealthReport lists the health of every connector of the datasource.
+type HealthReport struct {
+	Healthy      bool              `json:"healthy"`
+	ShuttingDown bool              `json:"shuttingDown"`
+	InFlight     int               `json:"inFlight"`
+	Connectors   []ConnectorHealth `json:"connectors"`
+}
+
+// Check pings the server and reads its topology. The driver reconnects by itself, so an unhealthy connector
+// recovers once the server is reachable again. A lazy connector that was not used yet is not connected by the
+// check, it is reported healthy and not connected.
+func (receiver *MongoConnector) Check(ctx context.Context) ConnectorHealth {
+	health := ConnectorHealth{
+		Name:      receiver.options.Name,
+		Topology:  TopologyUnknown,
+		Circuit:   receiver.CircuitState(),
+		CheckedAt: time.Now(),
+	}
+
+	client, err := receiver.connectedClient()
+	if err != nil {
+		health.Error = err.Error()
+		receiver.setLastHealth(health)
+		return health
+	}
+
+	if client == nil {
+		health.Healthy = true
+		receiver.setLastHealth(health)
+		return health
+	}
+	health.Connected = true
+
+	// The client fails with ErrClientDisconnected if the connector is disconnected meanwhile
+	start := time.Now()
+	err = client.Ping(ctx, nil)
+	health.Latency = time.Since(start)
+	if err != nil {
+		health.Error = err.Error()
+		receiver.setLastHealth(health)
+		return health
+	}
+
+	var hello bson.M
+	err = client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		health.Error = err.Error()
+		receiver.setLastHealth(health)
+		return health
+	}
+
+	health.Healthy = true
+	health.Topology, health.ReplicaSet, health.Primary = parseHello(hello)
+	receiver.setLastHealth(health)
+	return health
+}
+
+// LastHealth returns the result of the last health check, and false when the connector was not checked yet.
+func (receiver *MongoConnector) LastHealth() (ConnectorHealth, bool) {
+	receiver.healthMutex.Lock()
+	defer receiver.healthMutex.Unlock()
+
+	if receiver.lastHealth == nil {
+		return ConnectorHealth{}, false
+	}
+
+	return *receiver.lastHealth, true
+}
+
+func (receiver *MongoConnector) setLastHealth(health ConnectorHealth) {
+	receiver.healthMutex.Lock()
+	defer receiver.healthMutex.Unlock()
+
+	receiver.lastHealth = &health
+}
+
+func parseHello(hello bson.M) (Topology, string, string) {
+	if msg, _ := hello["msg"].(string); msg == "isdbgrid" {
+		return TopologySharded, "", ""
+	}
+
+	if setName, ok := hello["setName"].(string); ok {
+		primary, _ := hello["primary"].(string)
+		return TopologyReplicaSet, setName, primary
+	}
+
+	return TopologyStandalone, "", ""
+}
+
+// Health checks every connector concurrently.
+func (receiver *MongoDatasource) Health(ctx context.Context) HealthReport {
+	connectors := receiver.sortedConnectors()
+	report := HealthReport{
+		Healthy:      !receiver.isShuttingDown(),
+		ShuttingDown: receiver.isShuttingDown(),
+		InFlight:     receiver.inFlight.count(),
+		Connectors:   make([]ConnectorHealth, len(connectors)),
+	}
+
+	var wg sync.WaitGroup
+	for i, connector := range connectors {
+		wg.Add(1)
+		go func(i int, connector *MongoConnector) {
+			defer wg.Done()
+			report.Connectors[i] = connector.Check(ctx)
+		}(i, connector)
+	}
+	wg.Wait()
+
+	for _, health := range report.Connectors {
+		if !health.Healthy {
+			report.Healthy = false
+		}
+	}
+
+	return report
+}
+
+// StartHealthChecks checks the connectors every interval until Shutdown, logging the changes of their health.
+// The results are available through MongoConnector.LastHealth.
+func (receiver *MongoDatasource) StartHealthChecks(interval time.Duration) {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	receiver.lifecycleMutex.Lock()
+	defer receiver.lifecycleMutex.Unlock()
+
+	if receiver.stopHealthChecks != nil || receiver.shuttingDown {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	receiver.stopHealthChecks = cancel
+	receiver.healthChecksDone = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			for _, connector := range receiver.sortedConnectors() {
+				previous, checked := connector.LastHealth()
+
+				checkCtx, cancelCheck := context.WithTimeout(ctx, interval)
+				health := connector.Check(checkCtx)
+				cancelCheck()
+
+				if ctx.Err() != nil {
+					return
+				}
+
+				if health.Healthy && checked && !previous.Healthy {
+					receiver.getLogger().Info("connector recovered", "connector", health.Name, "latency", health.Latency)
+				} else if !health.Healthy && (!checked || previous.Healthy) {
+					receiver.getLogger().Error("connector unhealthy", "connector", health.Name, "error", health.Error)
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// LivenessHandler answers 200 while the datasource is not shut down. It does not check the connectors, a database
+// outage should not restart the process.
+func (receiver *MongoDatasource) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if receiver.isShuttingDown() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("shutting down\n"))
+			return
+		}
+
+		_, _ = w.Write([]byte("ok\n"))
+	})
+}
+
+// ReadinessHandler answers 200 with the HealthReport when every connector is healthy, and 503 otherwise or while
+// shutting down.
+func (receiver *MongoDatasource) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		report := receiver.Health(ctx)
+
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+	})
+}
+
+// Shutdown stops the health checks and waits for the running one, rejects the new repository operations with
+// ErrShuttingDown, waits for the in-flight ones and the background work of the instrumentations, like the explains
+// of the SlowQueryRecorder, and disconnects the connectors.
+// When ctx ends first the connectors are disconnected anyway and the context error is returned with the disconnect
+// errors.
+func (receiver *MongoDatasource) Shutdown(ctx context.Context) error {
+	return receiver.shutdown(ctx, true)
+}
+
+func (receiver *MongoDatasource) shutdown(ctx context.Context, waitInFlight bool) error {
+	receiver.lifecycleMutex.Lock()
+	receiver.shuttingDown = true
+	stopHealthChecks, healthChecksDone := receiver.stopHealthChecks, receiver.healthChecksDone
+	receiver.stopHealthChecks, receiver.healthChecksDone = nil, nil
+	receiver.lifecycleMutex.Unlock()
+
+	var messages []string
+	if stopHealthChecks != nil {
+		// The running check is cancelled, so it ends at once
+		stopHealthChecks()
+		<-healthChecksDone
+	}
+	if waitInFlight {
+		if err := receiver.inFlight.wait(ctx); err != nil {
+			messages = append(messages, fmt.Sprintf("waiting for %d operations: %v", receiver.inFlight.count(), err))
+		}
+
+		// The operations start their background work before they end, so none starts after this point
+		for _, instrumentation := range receiver.getInstrumentations() {
+			if background, ok := instrumentation.(backgroundInstrumentation); ok {
+				if err := background.waitBackground(ctx); err != nil {
+					messages = append(messages, fmt.Sprintf("waiting for the instrumentations: %v", err))
+					break
+				}
+			}
+		}
+	}
+
+	for _, connector := range receiver.sortedConnectors() {
+		disconnectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := connector.disconnect(disconnectCtx)
+		cancel()
+
+		if err != nil {
+			messages = append(messages, fmt.Sprintf("connector %s: %v", connector.options.Name, err))
+		}
+	}
+
+	if len(messages) > 0 {
+		return errors.New("shutdown: " + strings.Join(messages, "; "))
+	}
+
+	return nil
+}
+
+// admit counts a new operation in flight, unless the datasource is shutting down. The flag and the counter are
+// updated under the same lock, so Shutdown waits for every admitted operation.
+func (receiver *MongoDatasource) admit() error {
+	receiver.lifecycleMutex.Lock()
+	defer receiver.lifecycleMutex.Unlock()
+
+	if receiver.shuttingDown {
+		return ErrShuttingDown
+	}
+
+	receiver.inFlight.add()
+	return nil
+}
+
+func (receiver *MongoDatasource) isShuttingDown() bool {
+	receiver.lifecycleMutex.Lock()
+	defer receiver.lifecycleMutex.Unlock()
+
+	return receiver.shuttingDown
+}
+
+func (receiver *MongoDatasource) sortedConnectors() []*MongoConnector {
+	receiver.registryMutex.RLock()
+	defer receiver.registryMutex.RUnlock()
+
+	names := make([]string, 0, len(receiver.connectors))
+	for name := range receiver.connectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	connectors := make([]*MongoConnector, 0, len(names))
+	for _, name := range names {
+		connectors = append(connectors, receiver.connectors[name])
+	}
+
+	return connectors
+}
+
+// inFlightTracker counts the running operations and lets Shutdown wait until there are none.
+type inFlightTracker struct {
+	mutex   sync.Mutex
+	running int
+	idle    chan struct{} // Closed when running drops to zero, created by wait
+}
+
+func (tracker *inFlightTracker) add() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.running++
+}
+
+func (tracker *inFlightTracker) done() {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.running--
+	if tracker.running == 0 && tracker.idle != nil {
+		close(tracker.idle)
+		tracker.idle = nil
+	}
+}
+
+func (tracker *inFlightTracker) count() int {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	return tracker.running
+}
+
+func (tracker *inFlightTracker) wait(ctx context.Context) error {
+	tracker.mutex.Lock()
+	if tracker.running == 0 {
+		tracker.mutex.Unlock()
+		return nil
+	}
+
+	if tracker.idle == nil {
+		tracker.idle = make(chan struct{})
+	}
+	idle := tracker.idle
+	tracker.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
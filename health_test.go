@@ -0,0 +1,144 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestParseHello(t *testing.T) {
+	cases := []struct {
+		hello      bson.M
+		topology   Topology
+		replicaSet string
+		primary    string
+	}{
+		{hello: bson.M{"msg": "isdbgrid"}, topology: TopologySharded},
+		{hello: bson.M{"setName": "rs0", "primary": "db1:27017"}, topology: TopologyReplicaSet, replicaSet: "rs0", primary: "db1:27017"},
+		{hello: bson.M{"isWritablePrimary": true}, topology: TopologyStandalone},
+	}
+
+	for _, c := range cases {
+		topology, replicaSet, primary := parseHello(c.hello)
+		if topology != c.topology || replicaSet != c.replicaSet || primary != c.primary {
+			t.Fatalf("%v: got %s %q %q", c.hello, topology, replicaSet, primary)
+		}
+	}
+}
+
+func TestInFlightTracker(t *testing.T) {
+	tracker := &inFlightTracker{}
+	if err := tracker.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.add()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := tracker.wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tracker.done()
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tracker.wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	datasource := &MongoDatasource{}
+	repository := &MongoRepository[AssetTest]{schema: NewSchema(AssetTest{}), datasource: datasource}
+
+	operation, _ := repository.startOperation("Find")
+	if datasource.inFlight.count() != 1 {
+		t.Fatalf("expected 1 operation in flight, got %d", datasource.inFlight.count())
+	}
+
+	handler := datasource.LivenessHandler()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", recorder.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := datasource.Shutdown(ctx); err == nil {
+		t.Fatal("expected an error while the operation is in flight")
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", recorder.Code)
+	}
+
+	operation.end(0, nil)
+	if err := datasource.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repository.Find(lbq.Filter{}); err != ErrShuttingDown {
+		t.Fatalf("expected ErrShuttingDown, got %v", err)
+	}
+	if datasource.inFlight.count() != 0 {
+		t.Fatal("a rejected operation must not be counted in flight")
+	}
+}
+
+func TestHealthChecksDoNotConnectLazyConnectors(t *testing.T) {
+	datasource := &MongoDatasource{}
+	opts := MongoConnectorOpts{ClientOptions: *options.Client().ApplyURI("mongodb://localhost:27017"), Database: "test", Lazy: true}
+	if _, err := datasource.NewConnector("db", opts); err != nil {
+		t.Fatal(err)
+	}
+	connector, _ := datasource.GetConnector("db")
+
+	health := connector.Check(context.Background())
+	if !health.Healthy || health.Connected {
+		t.Fatalf("an unused lazy connector must be healthy and not connected, got %+v", health)
+	}
+	if connector.connected {
+		t.Fatal("the check must not connect a lazy connector")
+	}
+
+	datasource.StartHealthChecks(time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, checked := connector.LastHealth(); checked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the connector was not checked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := datasource.healthChecksDone
+	if err := datasource.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatal("Shutdown must wait for the health checks to stop")
+	}
+
+	// A disconnected connector is unhealthy
+	health = connector.Check(context.Background())
+	if health.Healthy || health.Error != ErrConnectorClosed.Error() {
+		t.Fatalf("a disconnected connector must be unhealthy, got %+v", health)
+	}
+}
@@ -0,0 +1,98 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexModels returns the indexes declared with the lb_index tag. A collection supports a single text index, so
+// all the text fields are combined in one index. The default collation of the repository is applied to the
+// ascending and descending indexes, so the queries using that collation can use them.
+func (repository *MongoRepository[T]) IndexModels() []mongo.IndexModel {
+	var bsonNames []string
+	for bsonName := range repository.schema.IndexedFields {
+		bsonNames = append(bsonNames, bsonName)
+	}
+	sort.Strings(bsonNames)
+
+	var models []mongo.IndexModel
+	textKeys := bson.D{}
+	textWeights := bson.M{}
+
+	for _, bsonName := range bsonNames {
+		index := repository.schema.IndexedFields[bsonName].Index
+
+		if index.Type == IndexText {
+			textKeys = append(textKeys, bson.E{Key: bsonName, Value: "text"})
+			if index.Weight > 0 {
+				textWeights[bsonName] = index.Weight
+			}
+			continue
+		}
+
+		indexOptions := options.Index()
+
+		var value interface{}
+		switch index.Type {
+		case IndexAscending:
+			value = 1
+			indexOptions.Collation = repository.Options.Collation
+		case IndexDescending:
+			value = -1
+			indexOptions.Collation = repository.Options.Collation
+		default:
+			value = string(index.Type)
+		}
+
+		if index.Unique {
+			indexOptions.SetUnique(true)
+		}
+		if index.Sparse {
+			indexOptions.SetSparse(true)
+		}
+
+		models = append(models, mongo.IndexModel{
+			Keys:    bson.D{{Key: bsonName, Value: value}},
+			Options: indexOptions,
+		})
+	}
+
+	if len(textKeys) > 0 {
+		indexOptions := options.Index()
+		if len(textWeights) > 0 {
+			indexOptions.SetWeights(textWeights)
+		}
+
+		models = append(models, mongo.IndexModel{
+			Keys:    textKeys,
+			Options: indexOptions,
+		})
+	}
+
+	return models
+}
+
+// CreateIndexes creates the indexes declared with the lb_index tag. Existing indexes with the same definition are
+// left untouched.
+func (repository *MongoRepository[T]) CreateIndexes() error {
+	if repository.connector == nil {
+		return errors.New("the repository has no connector")
+	}
+
+	models := repository.IndexModels()
+	if len(models) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := repository.getCollection().Indexes().CreateMany(ctx, models)
+	return err
+}
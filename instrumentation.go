@@ -0,0 +1,232 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Operation describes a repository call for the instrumentations. Filter, Sort and Limit are set by the time
+// StartOperation is called, unless the call failed before its query was built. Duration, Count and Err are set by
+// the time EndOperation is called.
+type Operation struct {
+	Model    string
+	Name     string
+	Filter   string // Shape of the query, the values are replaced by "?"
+	Sort     string // Sort of the query, e.g. "name:1,created:-1"
+	Limit    int64
+	Start    time.Time
+	Duration time.Duration
+	Count    int64 // Documents returned or affected
+	Retries  int   // Attempts that failed with a retryable error before the last one
+	Err      error
+
+	datasource       *MongoDatasource
+	explain          func(ctx context.Context) (*ExplainResult, error)
+	idempotent       bool // Running the write twice is safe, so it is retried after a network error
+	instrumentations []Instrumentation
+	contexts         []context.Context
+	started          bool // StartOperation was called on the instrumentations
+}
+
+// Instrumentation observes the repository calls, e.g. to start tracing spans or record metrics. The context
+// returned by StartOperation is passed to EndOperation. Implementations must be safe for concurrent use.
+type Instrumentation interface {
+	StartOperation(ctx context.Context, operation *Operation) context.Context
+	EndOperation(ctx context.Context, operation *Operation)
+}
+
+// backgroundInstrumentation is implemented by the instrumentations that keep working after EndOperation, like the
+// explains of the SlowQueryRecorder. Shutdown waits for that work before it disconnects the connectors.
+type backgroundInstrumentation interface {
+	waitBackground(ctx context.Context) error
+}
+
+// AddInstrumentation registers an instrumentation for the repositories of the datasource. The operations that
+// already started are not observed by it.
+func (receiver *MongoDatasource) AddInstrumentation(instrumentation Instrumentation) {
+	receiver.instrumentsMutex.Lock()
+	defer receiver.instrumentsMutex.Unlock()
+
+	receiver.instrumentations = append(receiver.instrumentations, instrumentation)
+}
+
+func (receiver *MongoDatasource) getInstrumentations() []Instrumentation {
+	receiver.instrumentsMutex.RLock()
+	defer receiver.instrumentsMutex.RUnlock()
+
+	return receiver.instrumentations
+}
+
+// startOperation admits the operation. The instrumentations are started by begin, once the shape of the query is
+// set on the operation.
+func (repository *MongoRepository[T]) startOperation(name string) (*Operation, error) {
+	operation := &Operation{
+		Model: repository.schema.Name,
+		Name:  name,
+		Start: time.Now(),
+	}
+
+	if repository.datasource == nil {
+		return operation, nil
+	}
+
+	if err := repository.datasource.admit(); err != nil {
+		return nil, err
+	}
+
+	operation.datasource = repository.datasource
+	operation.instrumentations = repository.datasource.getInstrumentations()
+
+	return operation, nil
+}
+
+// begin calls StartOperation of the instrumentations. It is called once the filter, sort and limit of the operation
+// are set, or by end when the operation failed before that.
+func (operation *Operation) begin() {
+	if operation.started {
+		return
+	}
+	operation.started = true
+
+	for _, instrumentation := range operation.instrumentations {
+		operation.contexts = append(operation.contexts, instrumentation.StartOperation(context.Background(), operation))
+	}
+}
+
+func (operation *Operation) setQuery(query bson.M) {
+	operation.Filter = queryShape(query)
+}
+
+func (operation *Operation) setFind(sort interface{}, limit *int64, explain func(ctx context.Context) (*ExplainResult, error)) {
+	operation.Sort = sortShape(sort)
+	if limit != nil {
+		operation.Limit = *limit
+	}
+	operation.explain = explain
+}
+
+// Explain explains the query of a Find, FindOne or Count operation. It returns nil for the other operations.
+func (operation *Operation) Explain(ctx context.Context) (*ExplainResult, error) {
+	if operation.explain == nil {
+		return nil, nil
+	}
+
+	return operation.explain(ctx)
+}
+
+func (operation *Operation) end(count int64, err error) {
+	operation.Duration = time.Since(operation.Start)
+	operation.Count = count
+	operation.Err = err
+
+	operation.begin()
+	for i, instrumentation := range operation.instrumentations {
+		instrumentation.EndOperation(operation.contexts[i], operation)
+	}
+
+	if operation.datasource == nil {
+		return
+	}
+	operation.datasource.inFlight.done()
+
+	threshold := operation.datasource.getSlowQueryThreshold()
+	if threshold > 0 && operation.Duration > threshold {
+		operation.datasource.getLogger().Warn("slow repository operation",
+			"model", operation.Model,
+			"operation", operation.Name,
+			"filter", operation.Filter,
+			"sort", operation.Sort,
+			"limit", operation.Limit,
+			"duration", operation.Duration,
+			"count", operation.Count,
+		)
+	}
+}
+
+// queryShape encodes the query with its values replaced by "?", so the queries that only differ in their values
+// share the shape. encoding/json sorts the keys.
+func queryShape(query bson.M) string {
+	if len(query) == 0 {
+		return "{}"
+	}
+
+	shape, err := json.Marshal(valueShape(query))
+	if err != nil {
+		return ""
+	}
+
+	return string(shape)
+}
+
+func sortShape(sort interface{}) string {
+	fields, ok := sort.(bson.D)
+	if !ok || len(fields) == 0 {
+		return ""
+	}
+
+	shape := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if _, isMeta := field.Value.(bson.M); isMeta {
+			shape = append(shape, field.Key+":meta")
+		} else {
+			shape = append(shape, fmt.Sprintf("%s:%v", field.Key, field.Value))
+		}
+	}
+
+	return strings.Join(shape, ",")
+}
+
+func valueShape(val interface{}) interface{} {
+	switch v := val.(type) {
+	case bson.M:
+		shape := make(map[string]interface{}, len(v))
+		for key, nested := range v {
+			shape[key] = valueShape(nested)
+		}
+		return shape
+	case map[string]interface{}:
+		return valueShape(bson.M(v))
+	case bson.D:
+		shape := make(map[string]interface{}, len(v))
+		for _, element := range v {
+			shape[element.Key] = valueShape(element.Value)
+		}
+		return shape
+	case bson.A:
+		return valueShape([]interface{}(v))
+	case []interface{}:
+		// Lists of conditions keep their shape, lists of values are a single value
+		shape := make([]interface{}, 0, len(v))
+		for _, element := range v {
+			switch element.(type) {
+			case bson.M, bson.D, map[string]interface{}:
+				shape = append(shape, valueShape(element))
+			default:
+				return "?"
+			}
+		}
+		return shape
+	default:
+		return "?"
+	}
+}
+
+// countOf returns the documents of a single result, or the length of a pointer to a slice.
+func countOf(val interface{}) int64 {
+	rv := reflect.ValueOf(val)
+	if !rv.IsValid() || (rv.Kind() == reflect.Pointer && rv.IsNil()) {
+		return 0
+	}
+
+	if rv.Kind() == reflect.Pointer && rv.Elem().Kind() == reflect.Slice {
+		return int64(rv.Elem().Len())
+	}
+
+	return 1
+}
@@ -0,0 +1,145 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type operationNameKey struct{}
+
+type recordingInstrumentation struct {
+	started        []string
+	startedFilters []string // Filter shapes seen by StartOperation
+	ended          []*Operation
+}
+
+func (instrumentation *recordingInstrumentation) StartOperation(ctx context.Context, operation *Operation) context.Context {
+	instrumentation.started = append(instrumentation.started, operation.Name)
+	instrumentation.startedFilters = append(instrumentation.startedFilters, operation.Filter)
+	return context.WithValue(ctx, operationNameKey{}, operation.Name)
+}
+
+func (instrumentation *recordingInstrumentation) EndOperation(ctx context.Context, operation *Operation) {
+	if ctx.Value(operationNameKey{}) != operation.Name {
+		panic("the context of StartOperation must be passed to EndOperation")
+	}
+	instrumentation.ended = append(instrumentation.ended, operation)
+}
+
+func TestInstrumentation(t *testing.T) {
+	instrumentation := &recordingInstrumentation{}
+	datasource := &MongoDatasource{}
+	datasource.AddInstrumentation(instrumentation)
+
+	repository := &MongoRepository[AssetTest]{schema: NewSchema(AssetTest{}), datasource: datasource}
+
+	operation, _ := repository.startOperation("Find")
+	operation.setQuery(bson.M{"name": "tank", "$or": bson.A{bson.M{"status": bson.M{"$in": bson.A{1, 2}}}}})
+	operation.end(3, nil)
+
+	if len(instrumentation.started) != 1 || len(instrumentation.ended) != 1 {
+		t.Fatal("the operation must be started and ended once")
+	}
+
+	ended := instrumentation.ended[0]
+	if ended.Model != "Asset" || ended.Count != 3 || ended.Err != nil {
+		t.Fatalf("invalid operation %+v", ended)
+	}
+
+	if ended.Filter != `{"$or":[{"status":{"$in":"?"}}],"name":"?"}` {
+		t.Fatalf("invalid filter shape %s", ended.Filter)
+	}
+
+	if countOf(&[]int{1, 2}) != 2 || countOf((*AssetTest)(nil)) != 0 || countOf(&AssetTest{}) != 1 || countOf(nil) != 0 {
+		t.Fatal("invalid document counts")
+	}
+}
+
+func TestQueryShapeSoftDelete(t *testing.T) {
+	repository := &MongoRepository[AssetTest]{schema: NewSchema(AssetTest{}), Options: RepositoryOptions{Deleted: true}}
+
+	shape := queryShape(repository.fixQuery(bson.M{"name": "tank", "status": bson.M{"$in": bson.A{1, 2}}}))
+	if shape != `{"$and":[{"name":"?","status":{"$in":"?"}},{"deleted":{"$type":"?"}}]}` {
+		t.Fatalf("invalid filter shape %s", shape)
+	}
+}
+
+func TestInstrumentationStartsWithTheFilter(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instrumentation := &recordingInstrumentation{}
+	datasource := &MongoDatasource{}
+	datasource.AddInstrumentation(instrumentation)
+
+	// The client is not connected, so the calls fail with ErrClientDisconnected once their query is built
+	repository := &MongoRepository[AssetTest]{
+		schema:         NewSchema(AssetTest{}),
+		collectionName: "Asset",
+		datasource:     datasource,
+		connector:      &MongoConnector{client: client, connected: true, options: &MongoConnectorOpts{Database: "test"}},
+	}
+
+	filter := lbq.Filter{Where: lbq.Where{"name": "tank"}, Limit: 5}
+	if _, err := repository.Find(filter); err != mongo.ErrClientDisconnected {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := repository.UpdateOne(lbq.Filter{Where: lbq.Where{"name": "tank"}}, bson.M{"icon": "tank"}); err != mongo.ErrClientDisconnected {
+		t.Fatalf("unexpected error %v", err)
+	}
+	for i, shape := range instrumentation.startedFilters {
+		if shape != `{"name":"?"}` {
+			t.Fatalf("%s: the filter must be set before StartOperation, got %q", instrumentation.started[i], shape)
+		}
+	}
+
+	// A call that fails before its query is built is still started and ended once
+	if _, err := repository.Find(lbq.Filter{Where: lbq.Where{"name": lbq.Where{"between": 1}}}); err == nil {
+		t.Fatal("expected an error for the invalid between")
+	}
+	if len(instrumentation.started) != 3 || len(instrumentation.ended) != 3 || instrumentation.startedFilters[2] != "" {
+		t.Fatalf("invalid operations %v", instrumentation.started)
+	}
+}
+
+func TestPrometheusExporter(t *testing.T) {
+	exporter := NewPrometheusExporter(0.1, 1)
+	exporter.EndOperation(context.Background(), &Operation{Model: "Asset", Name: "Find", Duration: 50 * time.Millisecond, Count: 2})
+	exporter.EndOperation(context.Background(), &Operation{Model: "Asset", Name: "Find", Duration: 2 * time.Second, Retries: 2, Err: errors.New("timeout")})
+
+	recorder := httptest.NewRecorder()
+	exporter.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	expected := []string{
+		`mongo_repository_operation_duration_seconds_bucket{model="Asset",operation="Find",le="0.1"} 1`,
+		`mongo_repository_operation_duration_seconds_bucket{model="Asset",operation="Find",le="1"} 1`,
+		`mongo_repository_operation_duration_seconds_bucket{model="Asset",operation="Find",le="+Inf"} 2`,
+		`mongo_repository_operation_duration_seconds_sum{model="Asset",operation="Find"} 2.05`,
+		`mongo_repository_operation_duration_seconds_count{model="Asset",operation="Find"} 2`,
+		`mongo_repository_operation_errors_total{model="Asset",operation="Find"} 1`,
+		`mongo_repository_operation_retries_total{model="Asset",operation="Find"} 2`,
+		`mongo_repository_operation_documents_total{model="Asset",operation="Find"} 2`,
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("missing %s in\n%s", line, body)
+		}
+	}
+
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatal("invalid content type")
+	}
+}
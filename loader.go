@@ -0,0 +1,160 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/xompass/lbq"
+)
+
+type LoaderOptions struct {
+	Wait     time.Duration // Window in which the calls are coalesced. Defaults to 2ms
+	MaxBatch int           // Ids per query, a full batch is sent without waiting. Defaults to 100
+}
+
+type loaderBatch[T IModel] struct {
+	ids     []interface{}
+	keys    map[string]bool
+	results map[string]*T
+	err     error
+	done    chan struct{}
+}
+
+// Loader coalesces the FindById calls made within a short window into a single query by id. It is meant to be
+// request-scoped: results are not cached between batches.
+type Loader[T IModel] struct {
+	repository *MongoRepository[T]
+	options    LoaderOptions
+	fetch      func(ids []interface{}) ([]T, error)
+
+	mutex sync.Mutex
+	batch *loaderBatch[T]
+}
+
+func NewLoader[T IModel](repository *MongoRepository[T], opts LoaderOptions) *Loader[T] {
+	if opts.Wait <= 0 {
+		opts.Wait = 2 * time.Millisecond
+	}
+
+	if opts.MaxBatch <= 0 {
+		opts.MaxBatch = 100
+	}
+
+	loader := &Loader[T]{
+		repository: repository,
+		options:    opts,
+	}
+
+	// Find applies the soft delete filter of the repository. The filter is built here, so the FilterPolicy does not
+	// apply to it
+	loader.fetch = func(ids []interface{}) ([]T, error) {
+		return repository.Find(lbq.Filter{
+			Where: lbq.Where{"id": lbq.Where{"inq": ids}},
+		}, NewQueryOptions().SetTrusted(true))
+	}
+
+	return loader
+}
+
+// Load returns the document with the given id, or nil when it does not exist.
+func (loader *Loader[T]) Load(ctx context.Context, id interface{}) (*T, error) {
+	key, err := normaliseId(id, loader.repository.schema)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := loader.add(id, key)
+
+	select {
+	case <-batch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if batch.err != nil {
+		return nil, batch.err
+	}
+
+	return batch.results[key], nil
+}
+
+// LoadMany loads the ids in the same batch and returns the documents and errors in the order of the ids.
+func (loader *Loader[T]) LoadMany(ctx context.Context, ids []interface{}) ([]*T, []error) {
+	results := make([]*T, len(ids))
+	errs := make([]error, len(ids))
+
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id interface{}) {
+			defer wg.Done()
+			results[i], errs[i] = loader.Load(ctx, id)
+		}(i, id)
+	}
+	wg.Wait()
+
+	return results, errs
+}
+
+// add appends the id to the current batch, starting a new one when required.
+func (loader *Loader[T]) add(id interface{}, key string) *loaderBatch[T] {
+	loader.mutex.Lock()
+	defer loader.mutex.Unlock()
+
+	if loader.batch == nil {
+		batch := &loaderBatch[T]{
+			keys: map[string]bool{},
+			done: make(chan struct{}),
+		}
+		loader.batch = batch
+		time.AfterFunc(loader.options.Wait, func() {
+			loader.dispatch(batch)
+		})
+	}
+
+	batch := loader.batch
+	if !batch.keys[key] {
+		batch.keys[key] = true
+		batch.ids = append(batch.ids, id)
+	}
+
+	if len(batch.ids) >= loader.options.MaxBatch {
+		loader.batch = nil
+		go loader.run(batch)
+	}
+
+	return batch
+}
+
+// dispatch runs the batch when its window ends, unless it was already sent because it was full.
+func (loader *Loader[T]) dispatch(batch *loaderBatch[T]) {
+	loader.mutex.Lock()
+	if loader.batch != batch {
+		loader.mutex.Unlock()
+		return
+	}
+	loader.batch = nil
+	loader.mutex.Unlock()
+
+	loader.run(batch)
+}
+
+func (loader *Loader[T]) run(batch *loaderBatch[T]) {
+	defer close(batch.done)
+
+	docs, err := loader.fetch(batch.ids)
+	if err != nil {
+		batch.err = err
+		return
+	}
+
+	batch.results = make(map[string]*T, len(docs))
+	for i := range docs {
+		key, err := normaliseId(docs[i].GetId(), loader.repository.schema)
+		if err != nil {
+			continue
+		}
+		batch.results[key] = &docs[i]
+	}
+}
@@ -0,0 +1,65 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestLoaderBatching(t *testing.T) {
+	loader := NewLoader[AssetTest](&MongoRepository[AssetTest]{schema: NewSchema(AssetTest{})}, LoaderOptions{Wait: 10 * time.Millisecond})
+
+	var mutex sync.Mutex
+	var batches [][]interface{}
+	loader.fetch = func(ids []interface{}) ([]AssetTest, error) {
+		mutex.Lock()
+		batches = append(batches, ids)
+		mutex.Unlock()
+
+		var docs []AssetTest
+		for _, id := range ids {
+			oid, _ := getObjectId(id)
+			docs = append(docs, AssetTest{PersistedModelWithId: PersistedModelWithId{Id: &oid}})
+		}
+		return docs, nil
+	}
+
+	first := primitive.NewObjectID()
+	second := primitive.NewObjectID()
+
+	// The hex string and the ObjectID of the same id are deduplicated
+	docs, errs := loader.LoadMany(context.Background(), []interface{}{first, first.Hex(), second, "invalid"})
+
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("expected a single batch with 2 ids, got %v", batches)
+	}
+
+	if errs[0] != nil || errs[1] != nil || errs[2] != nil {
+		t.Fatal(errs)
+	}
+
+	if *docs[0].Id != first || *docs[1].Id != first || *docs[2].Id != second {
+		t.Fatal("invalid results")
+	}
+
+	if errs[3] == nil {
+		t.Fatal("an invalid id must fail")
+	}
+}
+
+func TestLoaderError(t *testing.T) {
+	loader := NewLoader[AssetTest](&MongoRepository[AssetTest]{schema: NewSchema(AssetTest{})}, LoaderOptions{MaxBatch: 1})
+	fetchErr := errors.New("fetch error")
+	loader.fetch = func(ids []interface{}) ([]AssetTest, error) {
+		return nil, fetchErr
+	}
+
+	doc, err := loader.Load(context.Background(), primitive.NewObjectID())
+	if doc != nil || err != fetchErr {
+		t.Fatalf("expected the fetch error, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrLockHeld = errors.New("the lock is held by another owner")
+	ErrLockLost = errors.New("the lease is no longer held")
+)
+
+// Lease is a lock held until ExpiresAt.
+type Lease struct {
+	Name      string    `bson:"_id" json:"name"`
+	Owner     string    `bson:"owner" json:"owner"`
+	Token     string    `bson:"token" json:"token"`
+	Acquired  time.Time `bson:"acquired" json:"acquired"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+type LockManagerOptions struct {
+	CollectionName string // Defaults to "Lock"
+	Owner          string // Identifies this process in the leases. Defaults to the hostname
+}
+
+type LockManager struct {
+	connector      *MongoConnector
+	collectionName string
+	owner          string
+}
+
+// NewLockManager creates a lock manager backed by a collection of the given connector.
+func NewLockManager(ds *MongoDatasource, connectorName string, opts LockManagerOptions) (*LockManager, error) {
+	connector, err := ds.GetConnector(connectorName)
+	if err != nil {
+		return nil, err
+	}
+
+	collectionName := opts.CollectionName
+	if collectionName == "" {
+		collectionName = "Lock"
+	}
+
+	owner := opts.Owner
+	if owner == "" {
+		owner, _ = os.Hostname()
+	}
+
+	manager := &LockManager{
+		connector:      connector,
+		collectionName: collectionName,
+		owner:          owner,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = manager.getCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manager, nil
+}
+
+// Acquire takes the lock for the given ttl, or returns ErrLockHeld when another lease is active.
+func (manager *LockManager) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	if ttl <= 0 {
+		return nil, errors.New("the lease ttl must be positive")
+	}
+
+	token, err := newLeaseToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// A missing lease sorts before $$NOW
+	held := bson.M{"$gt": bson.A{"$expiresAt", "$$NOW"}}
+	keep := func(field string, value interface{}) bson.M {
+		return bson.M{"$cond": bson.A{held, "$" + field, value}}
+	}
+
+	upsert := true
+	after := options.After
+
+	lease := &Lease{}
+	err = manager.getCollection().FindOneAndUpdate(ctx,
+		bson.M{"_id": name},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"owner":     keep("owner", bson.M{"$literal": manager.owner}),
+			"token":     keep("token", bson.M{"$literal": token}),
+			"acquired":  keep("acquired", "$$NOW"),
+			"expiresAt": keep("expiresAt", leaseExpiry(ttl)),
+		}}}},
+		&options.FindOneAndUpdateOptions{Upsert: &upsert, ReturnDocument: &after},
+	).Decode(lease)
+
+	if err != nil {
+		// Two owners upserted a missing lease at once
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrLockHeld
+		}
+		return nil, err
+	}
+
+	if lease.Token != token {
+		return nil, ErrLockHeld
+	}
+
+	return lease, nil
+}
+
+// Renew extends the lease for the given ttl, or returns ErrLockLost when it expired.
+func (manager *LockManager) Renew(ctx context.Context, lease *Lease, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("the lease ttl must be positive")
+	}
+
+	after := options.After
+
+	renewed := &Lease{}
+	err := manager.getCollection().FindOneAndUpdate(ctx,
+		bson.M{
+			"_id":   lease.Name,
+			"token": lease.Token,
+			"$expr": bson.M{"$gt": bson.A{"$expiresAt", "$$NOW"}},
+		},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"expiresAt": leaseExpiry(ttl)}}}},
+		&options.FindOneAndUpdateOptions{ReturnDocument: &after},
+	).Decode(renewed)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrLockLost
+		}
+		return err
+	}
+
+	lease.ExpiresAt = renewed.ExpiresAt
+	return nil
+}
+
+// Release frees the lock so it can be acquired immediately.
+func (manager *LockManager) Release(ctx context.Context, lease *Lease) error {
+	result, err := manager.getCollection().DeleteOne(ctx, bson.M{"_id": lease.Name, "token": lease.Token})
+	if err != nil {
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+// leaseExpiry is the expression of the server time after the ttl.
+func leaseExpiry(ttl time.Duration) bson.M {
+	return bson.M{"$add": bson.A{"$$NOW", ttl.Milliseconds()}}
+}
+
+func newLeaseToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+func (manager *LockManager) getCollection() *mongo.Collection {
+	return manager.connector.getCollection(manager.collectionName)
+}
@@ -0,0 +1,73 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLockManager(t *testing.T) {
+	datasource := testDatasource(t)
+	first, err := NewLockManager(datasource, "db", LockManagerOptions{Owner: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewLockManager(datasource, "db", LockManagerOptions{Owner: "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, err := first.Acquire(ctx, "report", 0); err == nil {
+		t.Fatal("a lease without ttl must be rejected")
+	}
+
+	lease, err := first.Acquire(ctx, "report", 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Name != "report" || lease.Owner != "first" || lease.Token == "" {
+		t.Fatalf("invalid lease %+v", lease)
+	}
+
+	if _, err := second.Acquire(ctx, "report", time.Second); err != ErrLockHeld {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+
+	if err := first.Renew(ctx, lease, -time.Second); err == nil {
+		t.Fatal("a renewal without ttl must be rejected")
+	}
+	if err := first.Renew(ctx, lease, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	// An expired lease can not be renewed, even before another owner acquires the lock
+	time.Sleep(250 * time.Millisecond)
+	if err := first.Renew(ctx, lease, time.Second); err != ErrLockLost {
+		t.Fatalf("expected ErrLockLost on renew of an expired lease, got %v", err)
+	}
+
+	// Once the lease expires another owner steals the lock, and the previous lease is lost
+	stolen, err := second.Acquire(ctx, "report", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stolen.Owner != "second" || stolen.Token == lease.Token {
+		t.Fatalf("invalid stolen lease %+v", stolen)
+	}
+
+	if err := first.Renew(ctx, lease, time.Second); err != ErrLockLost {
+		t.Fatalf("expected ErrLockLost on renew, got %v", err)
+	}
+	if err := first.Release(ctx, lease); err != ErrLockLost {
+		t.Fatalf("expected ErrLockLost on release, got %v", err)
+	}
+
+	// A released lock can be acquired at once
+	if err := second.Release(ctx, stolen); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.Acquire(ctx, "report", time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,71 @@
+package go_mongo_repository
+
+import (
+	"time"
+)
+
+// Logger receives the structured events of the library. The args are alternating keys and values, so a
+// *slog.Logger can be used directly.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+type noopLogger struct{}
+
+func (noopLogger) Debug(string, ...any) {}
+func (noopLogger) Info(string, ...any)  {}
+func (noopLogger) Warn(string, ...any)  {}
+func (noopLogger) Error(string, ...any) {}
+
+// SetLogger sets the logger of the datasource. Nothing is logged by default.
+func (receiver *MongoDatasource) SetLogger(logger Logger) {
+	receiver.settingsMutex.Lock()
+	defer receiver.settingsMutex.Unlock()
+
+	receiver.logger = logger
+}
+
+// SetSlowQueryThreshold logs a warning for the repository operations that take longer than the threshold. Zero
+// disables it.
+func (receiver *MongoDatasource) SetSlowQueryThreshold(threshold time.Duration) {
+	receiver.settingsMutex.Lock()
+	defer receiver.settingsMutex.Unlock()
+
+	receiver.slowQueryThreshold = threshold
+}
+
+// defaultSlowQueryThreshold sets the threshold unless one is already set.
+func (receiver *MongoDatasource) defaultSlowQueryThreshold(threshold time.Duration) {
+	receiver.settingsMutex.Lock()
+	defer receiver.settingsMutex.Unlock()
+
+	if receiver.slowQueryThreshold <= 0 {
+		receiver.slowQueryThreshold = threshold
+	}
+}
+
+func (receiver *MongoDatasource) getSlowQueryThreshold() time.Duration {
+	receiver.settingsMutex.RLock()
+	defer receiver.settingsMutex.RUnlock()
+
+	return receiver.slowQueryThreshold
+}
+
+// getLogger returns the logger of the datasource, or one that discards the events. The receiver can be nil.
+func (receiver *MongoDatasource) getLogger() Logger {
+	if receiver == nil {
+		return noopLogger{}
+	}
+
+	receiver.settingsMutex.RLock()
+	defer receiver.settingsMutex.RUnlock()
+
+	if receiver.logger == nil {
+		return noopLogger{}
+	}
+
+	return receiver.logger
+}
@@ -0,0 +1,81 @@
+package go_mongo_repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type logEntry struct {
+	level string
+	msg   string
+	args  []any
+}
+
+// arg returns the value of the key in the args of the entry.
+func (entry logEntry) arg(key string) any {
+	for i := 0; i+1 < len(entry.args); i += 2 {
+		if entry.args[i] == key {
+			return entry.args[i+1]
+		}
+	}
+	return nil
+}
+
+type recordingLogger struct {
+	entries []logEntry
+}
+
+func (logger *recordingLogger) Debug(msg string, args ...any) { logger.add("debug", msg, args) }
+func (logger *recordingLogger) Info(msg string, args ...any)  { logger.add("info", msg, args) }
+func (logger *recordingLogger) Warn(msg string, args ...any)  { logger.add("warn", msg, args) }
+func (logger *recordingLogger) Error(msg string, args ...any) { logger.add("error", msg, args) }
+
+func (logger *recordingLogger) add(level string, msg string, args []any) {
+	logger.entries = append(logger.entries, logEntry{level: level, msg: msg, args: args})
+}
+
+func TestLogger(t *testing.T) {
+	var datasource *MongoDatasource
+	if _, ok := datasource.getLogger().(noopLogger); !ok {
+		t.Fatal("nothing must be logged by default")
+	}
+
+	logger := &recordingLogger{}
+	datasource = &MongoDatasource{}
+	datasource.SetLogger(logger)
+	datasource.SetSlowQueryThreshold(time.Millisecond)
+
+	repository := &MongoRepository[AssetTest]{schema: NewSchema(AssetTest{}), datasource: datasource}
+
+	parsedFilter, err := repository.parseFilter(lbq.Filter{Where: lbq.Where{"name": "tank", "unknown": 1, "other": 2}}, repository.queryOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsedFilter.DroppedFields) != 2 || parsedFilter.DroppedFields[0] != "other" {
+		t.Fatalf("invalid dropped fields %v", parsedFilter.DroppedFields)
+	}
+
+	limit := int64(5)
+	operation, _ := repository.startOperation("Find")
+	operation.setFind(bson.D{{Key: "name", Value: 1}}, &limit, nil)
+	operation.Start = time.Now().Add(-time.Second)
+	operation.end(0, nil)
+
+	operation, _ = repository.startOperation("Find")
+	operation.end(0, nil)
+
+	if len(logger.entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(logger.entries))
+	}
+
+	if logger.entries[0].level != "debug" || logger.entries[1].level != "warn" || logger.entries[1].msg != "slow repository operation" {
+		t.Fatalf("invalid entries %+v", logger.entries)
+	}
+
+	if logger.entries[1].arg("sort") != "name:1" || logger.entries[1].arg("limit") != int64(5) {
+		t.Fatalf("the slow operation must log its sort and limit, got %v", logger.entries[1].args)
+	}
+}
@@ -0,0 +1,300 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type OutboxStatus string
+
+const (
+	OutboxPending    OutboxStatus = "pending"    // Waiting to be published
+	OutboxDispatched OutboxStatus = "dispatched" // Published successfully
+	OutboxFailed     OutboxStatus = "failed"     // Gave up after the max attempts
+)
+
+// OutboxEvent is a domain event stored in the outbox collection.
+type OutboxEvent struct {
+	Id          primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Topic       string             `bson:"topic" json:"topic"`
+	Key         string             `bson:"key,omitempty" json:"key,omitempty"`
+	Payload     interface{}        `bson:"payload,omitempty" json:"payload,omitempty"`
+	Headers     map[string]string  `bson:"headers,omitempty" json:"headers,omitempty"`
+	Status      OutboxStatus       `bson:"status" json:"status"`
+	Attempts    int                `bson:"attempts" json:"attempts"`
+	LastError   string             `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	NextAttempt time.Time          `bson:"nextAttempt" json:"nextAttempt"`
+	Created     time.Time          `bson:"created" json:"created"`
+	Dispatched  *time.Time         `bson:"dispatched,omitempty" json:"dispatched,omitempty"`
+}
+
+type OutboxOptions struct {
+	CollectionName string // Defaults to "Outbox"
+}
+
+type Outbox struct {
+	connector      *MongoConnector
+	collectionName string
+	datasource     *MongoDatasource
+}
+
+// NewOutbox creates the outbox backed by a collection of the given connector.
+func NewOutbox(ds *MongoDatasource, connectorName string, opts OutboxOptions) (*Outbox, error) {
+	connector, err := ds.GetConnector(connectorName)
+	if err != nil {
+		return nil, err
+	}
+
+	collectionName := opts.CollectionName
+	if collectionName == "" {
+		collectionName = "Outbox"
+	}
+
+	outbox := &Outbox{
+		connector:      connector,
+		collectionName: collectionName,
+		datasource:     ds,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = outbox.GetCollection().Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "status", Value: 1}, {Key: "created", Value: 1}, {Key: "_id", Value: 1}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return outbox, nil
+}
+
+func (outbox *Outbox) GetCollection() *mongo.Collection {
+	return outbox.connector.getCollection(outbox.collectionName)
+}
+
+// Enqueue stores the events as pending.
+func (outbox *Outbox) Enqueue(ctx context.Context, events ...OutboxEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	documents := make([]interface{}, 0, len(events))
+	for _, event := range events {
+		if event.Topic == "" {
+			return errors.New("outbox event topic is required")
+		}
+
+		event.Id = primitive.NewObjectID()
+		event.Status = OutboxPending
+		event.Attempts = 0
+		event.LastError = ""
+		event.NextAttempt = now
+		event.Created = now
+		event.Dispatched = nil
+		documents = append(documents, event)
+	}
+
+	_, err := outbox.GetCollection().InsertMany(ctx, documents)
+	return err
+}
+
+// transaction runs fn and enqueues the events in the same transaction.
+func (outbox *Outbox) transaction(ctx context.Context, connector *MongoConnector, events []OutboxEvent, fn func(ctx context.Context) error) error {
+	if connector == nil || connector != outbox.connector {
+		return errors.New("the outbox and the repository must use the same connector")
+	}
+
+	// Join the transaction of the caller when there is one
+	session := mongo.SessionFromContext(ctx)
+	if inTransaction(session) {
+		if err := fn(ctx); err != nil {
+			return err
+		}
+
+		return outbox.Enqueue(ctx, events...)
+	}
+
+	if session == nil {
+		client, err := connector.getClient()
+		if err != nil {
+			return err
+		}
+
+		session, err = client.StartSession()
+		if err != nil {
+			return err
+		}
+		defer session.EndSession(ctx)
+	}
+
+	_, err := session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		if err := fn(sessCtx); err != nil {
+			return nil, err
+		}
+
+		return nil, outbox.Enqueue(sessCtx, events...)
+	})
+
+	return err
+}
+
+// inTransaction tells whether a transaction of the session is running.
+func inTransaction(session mongo.Session) bool {
+	xSession, ok := session.(mongo.XSession)
+	return ok && xSession.ClientSession().TransactionRunning()
+}
+
+// OutboxPublisher delivers the outbox events to the message broker.
+type OutboxPublisher interface {
+	Publish(ctx context.Context, event OutboxEvent) error
+}
+
+type OutboxRelayOptions struct {
+	BatchSize    int64         // Events read per iteration. Defaults to 100
+	PollInterval time.Duration // Wait between iterations when there is nothing to publish. Defaults to 1s
+	MaxAttempts  int           // Attempts before the event is marked as failed. Defaults to 10
+	MinBackoff   time.Duration // Delay after the first failed attempt. Defaults to 1s
+	MaxBackoff   time.Duration // Upper bound of the delay between attempts. Defaults to 5m
+}
+
+// OutboxRelay publishes the pending events in insertion order, one relay per outbox.
+type OutboxRelay struct {
+	outbox    *Outbox
+	publisher OutboxPublisher
+	options   OutboxRelayOptions
+}
+
+func NewOutboxRelay(outbox *Outbox, publisher OutboxPublisher, opts OutboxRelayOptions) *OutboxRelay {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 10
+	}
+
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 5 * time.Minute
+	}
+
+	return &OutboxRelay{
+		outbox:    outbox,
+		publisher: publisher,
+		options:   opts,
+	}
+}
+
+// Run dispatches the pending events until the context is cancelled.
+func (relay *OutboxRelay) Run(ctx context.Context) error {
+	for {
+		dispatched, err := relay.DispatchPending(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err != nil {
+			relay.outbox.datasource.getLogger().Error("outbox dispatch failed", "collection", relay.outbox.collectionName, "error", err)
+		}
+
+		// A full batch means there are probably more events waiting
+		if err == nil && int64(dispatched) == relay.options.BatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(relay.options.PollInterval):
+		}
+	}
+}
+
+// DispatchPending publishes one batch of pending events and returns how many were dispatched.
+func (relay *OutboxRelay) DispatchPending(ctx context.Context) (int, error) {
+	cursor, err := relay.outbox.GetCollection().Find(ctx, bson.M{"status": OutboxPending}, &options.FindOptions{
+		Sort:  bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}},
+		Limit: &relay.options.BatchSize,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var events []OutboxEvent
+	if err = cursor.All(ctx, &events); err != nil {
+		return 0, err
+	}
+
+	dispatched := 0
+	for _, event := range events {
+		if event.NextAttempt.After(time.Now()) {
+			break
+		}
+
+		if publishErr := relay.publisher.Publish(ctx, event); publishErr != nil {
+			failed, err := relay.markFailed(ctx, event, publishErr)
+			if err != nil {
+				return dispatched, err
+			}
+
+			if !failed {
+				break
+			}
+			continue
+		}
+
+		if err := relay.markDispatched(ctx, event); err != nil {
+			return dispatched, err
+		}
+		dispatched++
+	}
+
+	return dispatched, nil
+}
+
+func (relay *OutboxRelay) markDispatched(ctx context.Context, event OutboxEvent) error {
+	_, err := relay.outbox.GetCollection().UpdateOne(ctx, bson.M{"_id": event.Id, "status": OutboxPending}, bson.M{
+		"$set": bson.M{"status": OutboxDispatched, "dispatched": time.Now()},
+		"$inc": bson.M{"attempts": 1},
+	})
+	return err
+}
+
+// markFailed records the failed attempt and tells whether the event was given up.
+func (relay *OutboxRelay) markFailed(ctx context.Context, event OutboxEvent, publishErr error) (bool, error) {
+	attempts := event.Attempts + 1
+	set := bson.M{
+		"attempts":  attempts,
+		"lastError": publishErr.Error(),
+	}
+
+	logger := relay.outbox.datasource.getLogger()
+	failed := attempts >= relay.options.MaxAttempts
+	if failed {
+		set["status"] = OutboxFailed
+		logger.Error("outbox event failed", "id", event.Id.Hex(), "topic", event.Topic, "attempts", attempts, "error", publishErr)
+	} else {
+		nextAttempt := time.Now().Add(exponentialBackoff(attempts, relay.options.MinBackoff, relay.options.MaxBackoff))
+		set["nextAttempt"] = nextAttempt
+		logger.Warn("outbox event publish failed, retrying", "id", event.Id.Hex(), "topic", event.Topic, "attempts", attempts,
+			"nextAttempt", nextAttempt, "error", publishErr)
+	}
+
+	_, err := relay.outbox.GetCollection().UpdateOne(ctx, bson.M{"_id": event.Id, "status": OutboxPending}, bson.M{"$set": set})
+	return failed, err
+}
@@ -0,0 +1,240 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type recordingPublisher struct {
+	mutex     sync.Mutex
+	published []string
+	failures  map[string]int // Failures left by topic, -1 fails forever
+}
+
+func (publisher *recordingPublisher) Publish(_ context.Context, event OutboxEvent) error {
+	publisher.mutex.Lock()
+	defer publisher.mutex.Unlock()
+
+	publisher.published = append(publisher.published, event.Topic)
+	if failures := publisher.failures[event.Topic]; failures != 0 {
+		publisher.failures[event.Topic] = failures - 1
+		return errors.New("broker unavailable")
+	}
+
+	return nil
+}
+
+func outboxEvents(t *testing.T, outbox *Outbox) map[string]OutboxEvent {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := outbox.GetCollection().Find(ctx, bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []OutboxEvent
+	if err := cursor.All(ctx, &events); err != nil {
+		t.Fatal(err)
+	}
+
+	byTopic := map[string]OutboxEvent{}
+	for _, event := range events {
+		byTopic[event.Topic] = event
+	}
+
+	return byTopic
+}
+
+func TestOutboxRelay(t *testing.T) {
+	datasource := testDatasource(t)
+	outbox, err := NewOutbox(datasource, "db", OutboxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := outbox.Enqueue(ctx, OutboxEvent{Topic: "a"}, OutboxEvent{Topic: "b"}, OutboxEvent{Topic: "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &recordingPublisher{failures: map[string]int{"b": 1}}
+	relay := NewOutboxRelay(outbox, publisher, OutboxRelayOptions{MinBackoff: 100 * time.Millisecond})
+
+	// b fails, so c waits for it
+	dispatched, err := relay.DispatchPending(ctx)
+	if err != nil || dispatched != 1 {
+		t.Fatalf("expected 1 dispatched event, got %d, %v", dispatched, err)
+	}
+
+	events := outboxEvents(t, outbox)
+	if events["a"].Status != OutboxDispatched || events["a"].Dispatched == nil || events["a"].Attempts != 1 {
+		t.Fatalf("a must be dispatched, got %+v", events["a"])
+	}
+	if b := events["b"]; b.Status != OutboxPending || b.Attempts != 1 || b.LastError == "" || !b.NextAttempt.After(time.Now()) {
+		t.Fatalf("b must be rescheduled, got %+v", b)
+	}
+	if events["c"].Status != OutboxPending || events["c"].Attempts != 0 {
+		t.Fatalf("c must wait for b, got %+v", events["c"])
+	}
+
+	// b is not due yet
+	if dispatched, err := relay.DispatchPending(ctx); err != nil || dispatched != 0 {
+		t.Fatalf("expected no dispatched events, got %d, %v", dispatched, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if dispatched, err := relay.DispatchPending(ctx); err != nil || dispatched != 2 {
+		t.Fatalf("expected 2 dispatched events, got %d, %v", dispatched, err)
+	}
+
+	expected := []string{"a", "b", "b", "c"}
+	if len(publisher.published) != len(expected) {
+		t.Fatalf("expected the publications %v, got %v", expected, publisher.published)
+	}
+	for i, topic := range expected {
+		if publisher.published[i] != topic {
+			t.Fatalf("expected the publications %v, got %v", expected, publisher.published)
+		}
+	}
+}
+
+func TestOutboxRelayMaxAttempts(t *testing.T) {
+	datasource := testDatasource(t)
+	outbox, err := NewOutbox(datasource, "db", OutboxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := outbox.Enqueue(ctx, OutboxEvent{Topic: "poison"}, OutboxEvent{Topic: "next"}); err != nil {
+		t.Fatal(err)
+	}
+
+	publisher := &recordingPublisher{failures: map[string]int{"poison": -1}}
+	relay := NewOutboxRelay(outbox, publisher, OutboxRelayOptions{MaxAttempts: 1})
+
+	// The event given up no longer blocks the next ones
+	if dispatched, err := relay.DispatchPending(ctx); err != nil || dispatched != 1 {
+		t.Fatalf("expected 1 dispatched event, got %d, %v", dispatched, err)
+	}
+
+	events := outboxEvents(t, outbox)
+	if events["poison"].Status != OutboxFailed || events["next"].Status != OutboxDispatched {
+		t.Fatalf("invalid events %+v", events)
+	}
+}
+
+func TestOutboxJoinsTransaction(t *testing.T) {
+	datasource := testDatasource(t)
+	connector, _ := datasource.GetConnector("db")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if health := connector.Check(ctx); health.Topology == TopologyStandalone {
+		t.Skip("transactions require a replica set")
+	}
+
+	outbox, err := NewOutbox(datasource, "db", OutboxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repository, err := NewRepository[AssetTest](datasource, RepositoryOptions{Outbox: outbox})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The collections of a transaction must exist on the older servers
+	if err := connector.GetDriver().Database(connector.GetOptions().Database).CreateCollection(ctx, "Asset"); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := connector.StartCausalSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.EndSession(ctx)
+
+	if err := session.StartTransaction(); err != nil {
+		t.Fatal(err)
+	}
+
+	name := "tank"
+	_, err = repository.WithEvents(OutboxEvent{Topic: "asset.created"}).Insert(AssetTest{Name: &name}, NewQueryOptions().SetSession(session))
+	if err != nil {
+		t.Fatalf("the outbox must join the transaction of the caller: %v", err)
+	}
+
+	if err := session.AbortTransaction(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both writes belong to the aborted transaction
+	if count, err := repository.Count(lbq.Filter{}); err != nil || count != 0 {
+		t.Fatalf("the document must be rolled back, got %d, %v", count, err)
+	}
+	if events := outboxEvents(t, outbox); len(events) != 0 {
+		t.Fatalf("the events must be rolled back, got %+v", events)
+	}
+}
+
+func TestWithEventsEnqueuedOnce(t *testing.T) {
+	repository := &MongoRepository[AssetTest]{schema: NewSchema(AssetTest{})}
+	clone := repository.WithEvents(OutboxEvent{Topic: "asset.created"})
+
+	// A failed write leaves the events for the next one
+	if err := clone.write(nil, nil, func(context.Context, *mongo.Collection) error { return nil }); err == nil {
+		t.Fatal("expected an error without an outbox")
+	}
+
+	events := clone.events.take()
+	if len(events) != 1 || events[0].Topic != "asset.created" {
+		t.Fatalf("the events must be kept after a failed write, got %+v", events)
+	}
+
+	// Once taken, the next writes of the copy have no events
+	if events := clone.events.take(); len(events) != 0 {
+		t.Fatalf("the events must be taken once, got %+v", events)
+	}
+	if repository.events.take() != nil {
+		t.Fatal("the original repository must have no events")
+	}
+}
+
+func TestOutboxRelayRunLogsErrors(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := &recordingLogger{}
+	datasource := &MongoDatasource{}
+	datasource.SetLogger(logger)
+
+	outbox := &Outbox{
+		connector:      &MongoConnector{client: client, connected: true, options: &MongoConnectorOpts{Database: "test"}},
+		collectionName: "Outbox",
+		datasource:     datasource,
+	}
+	relay := NewOutboxRelay(outbox, &recordingPublisher{}, OutboxRelayOptions{PollInterval: time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := relay.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+
+	if len(logger.entries) == 0 || logger.entries[0].msg != "outbox dispatch failed" || logger.entries[0].level != "error" {
+		t.Fatalf("the dispatch errors must be logged, got %+v", logger.entries)
+	}
+}
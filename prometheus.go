@@ -0,0 +1,155 @@
+package go_mongo_repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultDurationBuckets are the upper bounds, in seconds, of the duration histograms.
+var DefaultDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type operationKey struct {
+	model     string
+	operation string
+}
+
+type operationSeries struct {
+	buckets   []uint64 // Not cumulative, they are accumulated when written
+	count     uint64
+	sum       float64
+	errors    uint64
+	retries   uint64
+	documents int64
+}
+
+// PrometheusExporter is an Instrumentation that keeps per model and per operation histograms of the durations,
+// and counters of the errors, retries and documents. It serves them in the Prometheus text format.
+type PrometheusExporter struct {
+	mutex   sync.Mutex
+	buckets []float64
+	series  map[operationKey]*operationSeries
+}
+
+func NewPrometheusExporter(buckets ...float64) *PrometheusExporter {
+	if len(buckets) == 0 {
+		buckets = DefaultDurationBuckets
+	}
+
+	sortedBuckets := append([]float64{}, buckets...)
+	sort.Float64s(sortedBuckets)
+
+	return &PrometheusExporter{
+		buckets: sortedBuckets,
+		series:  map[operationKey]*operationSeries{},
+	}
+}
+
+func (exporter *PrometheusExporter) StartOperation(ctx context.Context, _ *Operation) context.Context {
+	return ctx
+}
+
+func (exporter *PrometheusExporter) EndOperation(_ context.Context, operation *Operation) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+
+	key := operationKey{model: operation.Model, operation: operation.Name}
+	series, ok := exporter.series[key]
+	if !ok {
+		series = &operationSeries{buckets: make([]uint64, len(exporter.buckets))}
+		exporter.series[key] = series
+	}
+
+	seconds := operation.Duration.Seconds()
+	for i, upperBound := range exporter.buckets {
+		if seconds <= upperBound {
+			series.buckets[i]++
+			break
+		}
+	}
+
+	series.count++
+	series.sum += seconds
+	series.documents += operation.Count
+	if operation.Err != nil {
+		series.errors++
+	}
+	series.retries += uint64(operation.Retries)
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (exporter *PrometheusExporter) WriteTo(w io.Writer) (int64, error) {
+	var buffer bytes.Buffer
+
+	exporter.mutex.Lock()
+	keys := make([]operationKey, 0, len(exporter.series))
+	for key := range exporter.series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].model != keys[j].model {
+			return keys[i].model < keys[j].model
+		}
+		return keys[i].operation < keys[j].operation
+	})
+
+	buffer.WriteString("# HELP mongo_repository_operation_duration_seconds Duration of the repository operations.\n")
+	buffer.WriteString("# TYPE mongo_repository_operation_duration_seconds histogram\n")
+	for _, key := range keys {
+		series := exporter.series[key]
+		labels := key.labels()
+
+		var cumulative uint64
+		for i, upperBound := range exporter.buckets {
+			cumulative += series.buckets[i]
+			fmt.Fprintf(&buffer, "mongo_repository_operation_duration_seconds_bucket{%s,le=\"%s\"} %d\n",
+				labels, strconv.FormatFloat(upperBound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(&buffer, "mongo_repository_operation_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, series.count)
+		fmt.Fprintf(&buffer, "mongo_repository_operation_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(series.sum, 'g', -1, 64))
+		fmt.Fprintf(&buffer, "mongo_repository_operation_duration_seconds_count{%s} %d\n", labels, series.count)
+	}
+
+	buffer.WriteString("# HELP mongo_repository_operation_errors_total Repository operations that returned an error.\n")
+	buffer.WriteString("# TYPE mongo_repository_operation_errors_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&buffer, "mongo_repository_operation_errors_total{%s} %d\n", key.labels(), exporter.series[key].errors)
+	}
+
+	buffer.WriteString("# HELP mongo_repository_operation_retries_total Attempts of the repository operations retried after a transient error.\n")
+	buffer.WriteString("# TYPE mongo_repository_operation_retries_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&buffer, "mongo_repository_operation_retries_total{%s} %d\n", key.labels(), exporter.series[key].retries)
+	}
+
+	buffer.WriteString("# HELP mongo_repository_operation_documents_total Documents returned or affected by the repository operations.\n")
+	buffer.WriteString("# TYPE mongo_repository_operation_documents_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&buffer, "mongo_repository_operation_documents_total{%s} %d\n", key.labels(), exporter.series[key].documents)
+	}
+	exporter.mutex.Unlock()
+
+	return buffer.WriteTo(w)
+}
+
+// ServeHTTP serves the metrics, so the exporter can be registered in any mux.
+func (exporter *PrometheusExporter) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = exporter.WriteTo(w)
+}
+
+func (key operationKey) labels() string {
+	return fmt.Sprintf("model=\"%s\",operation=\"%s\"", escapeLabelValue(key.model), escapeLabelValue(key.operation))
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
@@ -0,0 +1,301 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// QueryOptions configures a single repository call. The options that are not set fall back to the defaults of the
+// RepositoryOptions.
+type QueryOptions struct {
+	Collation      *options.Collation
+	Trusted        bool        // The filter is built by the application, the FilterPolicy is not applied
+	Hint           interface{} // Index name or keys document
+	MaxTime        *time.Duration
+	Comment        *string
+	ReadPreference *readpref.ReadPref       // Applies to Find, FindOne, Count and Aggregate
+	ReadConcern    *readconcern.ReadConcern // Applies to Find, FindOne, Count and Aggregate
+	AllowDiskUse   *bool                    // Applies to Find and Aggregate
+	BatchSize      *int32                   // Applies to Find and Aggregate
+	Session        mongo.Session            // Session of the operations, see StartCausalSession
+	WriteConcern   *writeconcern.WriteConcern
+
+	where lbq.Where // Conditions added by the library, like the id of FindById. They are trusted
+}
+
+func NewQueryOptions() *QueryOptions {
+	return &QueryOptions{}
+}
+
+func (queryOptions *QueryOptions) SetCollation(collation *options.Collation) *QueryOptions {
+	queryOptions.Collation = collation
+	return queryOptions
+}
+
+func (queryOptions *QueryOptions) SetTrusted(trusted bool) *QueryOptions {
+	queryOptions.Trusted = trusted
+	return queryOptions
+}
+
+func (queryOptions *QueryOptions) SetHint(hint interface{}) *QueryOptions {
+	queryOptions.Hint = hint
+	return queryOptions
+}
+
+func (queryOptions *QueryOptions) SetMaxTime(maxTime time.Duration) *QueryOptions {
+	queryOptions.MaxTime = &maxTime
+	return queryOptions
+}
+
+func (queryOptions *QueryOptions) SetComment(comment string) *QueryOptions {
+	queryOptions.Comment = &comment
+	return queryOptions
+}
+
+func (queryOptions *QueryOptions) SetReadPreference(readPreference *readpref.ReadPref) *QueryOptions {
+	queryOptions.ReadPreference = readPreference
+	return queryOptions
+}
+
+func (queryOptions *QueryOptions) SetReadConcern(readConcern *readconcern.ReadConcern) *QueryOptions {
+	queryOptions.ReadConcern = readConcern
+	return queryOptions
+}
+
+func (queryOptions *QueryOptions) SetAllowDiskUse(allowDiskUse bool) *QueryOptions {
+	queryOptions.AllowDiskUse = &allowDiskUse
+	return queryOptions
+}
+
+func (queryOptions *QueryOptions) SetBatchSize(batchSize int32) *QueryOptions {
+	queryOptions.BatchSize = &batchSize
+	return queryOptions
+}
+
+func (queryOptions *QueryOptions) SetWriteConcern(writeConcern *writeconcern.WriteConcern) *QueryOptions {
+	queryOptions.WriteConcern = writeConcern
+	return queryOptions
+}
+
+func (queryOptions *QueryOptions) SetSession(session mongo.Session) *QueryOptions {
+	queryOptions.Session = session
+	return queryOptions
+}
+
+// withId returns the options that restrict a call to the document with the given id.
+func withId(id interface{}) *QueryOptions {
+	return &QueryOptions{where: lbq.Where{"id": id}}
+}
+
+// mergeQueryOptions combines the options in order, the last value set for each option wins.
+func mergeQueryOptions(opts ...*QueryOptions) *QueryOptions {
+	merged := &QueryOptions{}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+
+		if opt.Collation != nil {
+			merged.Collation = opt.Collation
+		}
+
+		if opt.Trusted {
+			merged.Trusted = true
+		}
+
+		if opt.Hint != nil {
+			merged.Hint = opt.Hint
+		}
+
+		if opt.MaxTime != nil {
+			merged.MaxTime = opt.MaxTime
+		}
+
+		if opt.Comment != nil {
+			merged.Comment = opt.Comment
+		}
+
+		if opt.ReadPreference != nil {
+			merged.ReadPreference = opt.ReadPreference
+		}
+
+		if opt.ReadConcern != nil {
+			merged.ReadConcern = opt.ReadConcern
+		}
+
+		if opt.AllowDiskUse != nil {
+			merged.AllowDiskUse = opt.AllowDiskUse
+		}
+
+		if opt.BatchSize != nil {
+			merged.BatchSize = opt.BatchSize
+		}
+
+		if opt.Session != nil {
+			merged.Session = opt.Session
+		}
+
+		if opt.WriteConcern != nil {
+			merged.WriteConcern = opt.WriteConcern
+		}
+
+		if opt.where != nil {
+			merged.where = opt.where
+		}
+	}
+
+	return merged
+}
+
+// queryOptions returns the options of a call, starting from the repository defaults.
+func (repository *MongoRepository[T]) queryOptions(opts []*QueryOptions) *QueryOptions {
+	defaults := &QueryOptions{
+		Collation:      repository.Options.Collation,
+		ReadPreference: repository.Options.ReadPreference,
+		WriteConcern:   repository.Options.WriteConcern,
+	}
+
+	if defaults.ReadPreference == nil && repository.connector != nil {
+		defaults.ReadPreference = repository.connector.defaultReadPreference()
+	}
+
+	return mergeQueryOptions(append([]*QueryOptions{defaults}, opts...)...)
+}
+
+// comment returns the comment for the driver options that take any value, nil when it is not set.
+func (queryOptions *QueryOptions) comment() interface{} {
+	if queryOptions.Comment == nil {
+		return nil
+	}
+
+	return *queryOptions.Comment
+}
+
+func (queryOptions *QueryOptions) updateOptions() *options.UpdateOptions {
+	return &options.UpdateOptions{
+		Collation: queryOptions.Collation,
+		Hint:      queryOptions.Hint,
+		Comment:   queryOptions.comment(),
+	}
+}
+
+func (queryOptions *QueryOptions) deleteOptions() *options.DeleteOptions {
+	return &options.DeleteOptions{
+		Collation: queryOptions.Collation,
+		Hint:      queryOptions.Hint,
+		Comment:   queryOptions.comment(),
+	}
+}
+
+// sessionContext binds the session of the options to the context. queryOptions can be nil.
+func (queryOptions *QueryOptions) sessionContext(ctx context.Context) context.Context {
+	if queryOptions == nil || queryOptions.Session == nil {
+		return ctx
+	}
+
+	return mongo.NewSessionContext(ctx, queryOptions.Session)
+}
+
+// readCollection returns the collection with the read preference and read concern of the call.
+func (repository *MongoRepository[T]) readCollection(queryOptions *QueryOptions) (*mongo.Collection, error) {
+	if queryOptions.ReadPreference == nil && queryOptions.ReadConcern == nil {
+		return repository.getCollection(), nil
+	}
+
+	collectionOptions := options.Collection()
+	if queryOptions.ReadPreference != nil {
+		collectionOptions.SetReadPreference(queryOptions.ReadPreference)
+	}
+	if queryOptions.ReadConcern != nil {
+		collectionOptions.SetReadConcern(queryOptions.ReadConcern)
+	}
+
+	return repository.getCollection().Clone(collectionOptions)
+}
+
+// writeCollection returns the collection with the write concern of the call. queryOptions can be nil.
+func (repository *MongoRepository[T]) writeCollection(queryOptions *QueryOptions) (*mongo.Collection, error) {
+	if queryOptions == nil || queryOptions.WriteConcern == nil {
+		return repository.getCollection(), nil
+	}
+
+	return repository.getCollection().Clone(options.Collection().SetWriteConcern(queryOptions.WriteConcern))
+}
+
+// parseFilter translates the filter, applying the FilterPolicy of the repository unless the filter is trusted. The
+// conditions added by the library are not subject to the policy, they are combined with the translated where.
+func (repository *MongoRepository[T]) parseFilter(filter lbq.Filter, queryOptions *QueryOptions) (MongoFilter, error) {
+	parsedFilter, err := lbFilterQueryWithPolicy(filter, repository.schema, repository.filterPolicy(queryOptions))
+	if err != nil {
+		return parsedFilter, err
+	}
+
+	if len(parsedFilter.DroppedFields) > 0 {
+		repository.datasource.getLogger().Debug("unknown filter fields ignored",
+			"model", repository.schema.Name,
+			"fields", parsedFilter.DroppedFields,
+		)
+	}
+
+	return parsedFilter, repository.addInternalWhere(&parsedFilter, queryOptions)
+}
+
+// addInternalWhere adds the conditions of the library to the translated where.
+func (repository *MongoRepository[T]) addInternalWhere(parsedFilter *MongoFilter, queryOptions *QueryOptions) error {
+	if queryOptions.where == nil {
+		return nil
+	}
+
+	internalFilter, err := lbFilterQuery(lbq.Filter{Where: queryOptions.where}, repository.schema)
+	if err != nil {
+		return err
+	}
+
+	if len(parsedFilter.Where) == 0 {
+		parsedFilter.Where = internalFilter.Where
+	} else {
+		parsedFilter.Where = bson.M{"$and": bson.A{internalFilter.Where, parsedFilter.Where}}
+	}
+
+	return nil
+}
+
+// filterPolicy returns the policy applied to the call, nil when there is none or the filter is trusted.
+func (repository *MongoRepository[T]) filterPolicy(queryOptions *QueryOptions) *FilterPolicy {
+	if queryOptions.Trusted {
+		return nil
+	}
+
+	return repository.Options.FilterPolicy
+}
+
+// checkIndexUsage explains the query when the policy requires an index, and rejects the plans that scan the
+// collection. The explain runs outside the session of the caller, since the server rejects it in a transaction.
+func (repository *MongoRepository[T]) checkIndexUsage(query bson.M, sort interface{}, queryOptions *QueryOptions) error {
+	policy := repository.filterPolicy(queryOptions)
+	if policy == nil || !policy.RequireIndex {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := repository.explainContext(ctx, repository.findCommand(query, sort, queryOptions), ExplainQueryPlanner)
+	if err != nil {
+		return err
+	}
+
+	if result.CollectionScan {
+		return ErrCollectionScan
+	}
+
+	return nil
+}
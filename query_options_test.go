@@ -0,0 +1,134 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+func TestQueryOptionsCollation(t *testing.T) {
+	defaultCollation := &options.Collation{Locale: "es", Strength: 1}
+	repository := &MongoRepository[AssetTest]{
+		schema:  NewSchema(AssetTest{}),
+		Options: RepositoryOptions{Collation: defaultCollation},
+	}
+
+	if repository.queryOptions(nil).Collation != defaultCollation {
+		t.Fatal("the default collation must be used when the call has no options")
+	}
+
+	callCollation := &options.Collation{Locale: "en", Strength: 2}
+	merged := repository.queryOptions([]*QueryOptions{nil, NewQueryOptions().SetCollation(callCollation)})
+	if merged.Collation != callCollation {
+		t.Fatal("the collation of the call must override the default")
+	}
+
+	if repository.queryOptions([]*QueryOptions{NewQueryOptions()}).Collation != defaultCollation {
+		t.Fatal("an unset collation must keep the default")
+	}
+
+	// The default collation is applied to the ascending index but not to the text index
+	models := repository.IndexModels()
+	if models[0].Options.Collation != defaultCollation {
+		t.Fatal("the referenceId index must use the default collation")
+	}
+	if models[1].Options.Collation != nil {
+		t.Fatal("the text index does not support collations")
+	}
+
+	cached := NewCachedRepository[AssetTest](repository, NewLRUCache(10), CacheOptions{})
+	defaultKey, _ := cached.idKey("000000000000000000000000", nil)
+	callKey, _ := cached.idKey("000000000000000000000000", []*QueryOptions{NewQueryOptions().SetCollation(callCollation)})
+	if defaultKey == callKey {
+		t.Fatal("the cache keys must depend on the collation")
+	}
+}
+
+func TestQueryOptionsMerge(t *testing.T) {
+	defaults := NewQueryOptions().SetMaxTime(time.Second).SetComment("default").SetBatchSize(100)
+	call := NewQueryOptions().SetHint("name_1").SetComment("call").SetReadPreference(readpref.SecondaryPreferred())
+
+	merged := mergeQueryOptions(defaults, nil, call)
+	if merged.Hint != "name_1" || *merged.Comment != "call" || *merged.MaxTime != time.Second || *merged.BatchSize != 100 {
+		t.Fatalf("invalid merged options %+v", merged)
+	}
+
+	if merged.ReadPreference.Mode() != readpref.SecondaryPreferredMode {
+		t.Fatal("the read preference of the call must be kept")
+	}
+
+	updateOptions := merged.updateOptions()
+	if updateOptions.Hint != "name_1" || updateOptions.Comment != "call" {
+		t.Fatal("the hint and comment must be passed to the update options")
+	}
+
+	if NewQueryOptions().deleteOptions().Comment != nil {
+		t.Fatal("an unset comment must be nil")
+	}
+}
+
+func TestDefaultReadPreference(t *testing.T) {
+	connector := &MongoConnector{options: &MongoConnectorOpts{DefaultReadPreference: readpref.SecondaryPreferred()}}
+	repository := &MongoRepository[AssetTest]{schema: NewSchema(AssetTest{}), connector: connector}
+
+	if repository.queryOptions(nil).ReadPreference.Mode() != readpref.SecondaryPreferredMode {
+		t.Fatal("the read preference of the connector must be the default")
+	}
+
+	repository.Options.ReadPreference = readpref.Nearest()
+	if repository.queryOptions(nil).ReadPreference.Mode() != readpref.NearestMode {
+		t.Fatal("the read preference of the repository must override the connector")
+	}
+
+	primary := NewQueryOptions().SetReadPreference(readpref.Primary())
+	if repository.queryOptions([]*QueryOptions{primary}).ReadPreference.Mode() != readpref.PrimaryMode {
+		t.Fatal("the read preference of the call must override the repository")
+	}
+
+	var noOptions *QueryOptions
+	ctx := context.Background()
+	if noOptions.sessionContext(ctx) != ctx {
+		t.Fatal("the context must not change without a session")
+	}
+}
+
+func TestWriteConcern(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repository := &MongoRepository[AssetTest]{
+		schema:         NewSchema(AssetTest{}),
+		collectionName: "Asset",
+		connector:      &MongoConnector{client: client, connected: true, options: &MongoConnectorOpts{Database: "test"}},
+	}
+
+	collection, err := repository.writeCollection(repository.queryOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collection != repository.getCollection() {
+		t.Fatal("the collection is shared when there is no write concern")
+	}
+
+	repository.Options.WriteConcern = writeconcern.New(writeconcern.W(1))
+	majority := writeconcern.New(writeconcern.WMajority(), writeconcern.J(true))
+	queryOptions := repository.queryOptions([]*QueryOptions{NewQueryOptions().SetWriteConcern(majority)})
+	if queryOptions.WriteConcern != majority {
+		t.Fatal("the write concern of the call must override the repository")
+	}
+
+	collection, err = repository.writeCollection(queryOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if collection == repository.getCollection() {
+		t.Fatal("the collection must be derived for the write concern of the call")
+	}
+}
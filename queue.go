@@ -0,0 +1,343 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type JobStatus string
+
+const (
+	JobPending   JobStatus = "pending"   // Waiting for its run time
+	JobRunning   JobStatus = "running"   // Claimed by a worker with an active lease
+	JobCompleted JobStatus = "completed" // Finished successfully
+	JobDead      JobStatus = "dead"      // Failed more than the max attempts
+)
+
+var ErrJobLeaseLost = errors.New("the job is not leased by the given owner")
+
+// JobFields holds the queue state of a job, embedded inline in the job models.
+type JobFields struct {
+	Status     JobStatus  `bson:"status,omitempty" json:"status,omitempty"`
+	Priority   int        `bson:"priority" json:"priority"`
+	RunAt      *time.Time `bson:"runAt,omitempty" json:"runAt,omitempty"`
+	Attempts   int        `bson:"attempts" json:"attempts"`
+	Owner      string     `bson:"owner,omitempty" json:"owner,omitempty"`
+	LeaseUntil *time.Time `bson:"leaseUntil,omitempty" json:"leaseUntil,omitempty"`
+	LastError  string     `bson:"lastError,omitempty" json:"lastError,omitempty"`
+	Finished   *time.Time `bson:"finished,omitempty" json:"finished,omitempty"`
+}
+
+type JobQueueOptions struct {
+	Repository        RepositoryOptions
+	VisibilityTimeout time.Duration // Lease granted by Claim and Heartbeat. Defaults to 30s
+	MaxAttempts       int           // Attempts before the job is moved to the dead state. Defaults to 5
+	MinBackoff        time.Duration // Delay after the first failure. Defaults to 1s
+	MaxBackoff        time.Duration // Upper bound of the delay between attempts. Defaults to 1h
+}
+
+type EnqueueOptions struct {
+	Priority int       // Higher priorities are claimed first
+	RunAt    time.Time // The job is not claimed before this time. Defaults to now
+}
+
+// JobQueue is a work queue stored in the collection of the model T, which must embed JobFields inline.
+type JobQueue[T IModel] struct {
+	repository *MongoRepository[T]
+	options    JobQueueOptions
+}
+
+func NewJobQueue[T IModel](ds *MongoDatasource, opts JobQueueOptions) (*JobQueue[T], error) {
+	if opts.VisibilityTimeout <= 0 {
+		opts.VisibilityTimeout = 30 * time.Second
+	}
+
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = time.Second
+	}
+
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Hour
+	}
+
+	repository, err := NewRepository[T](ds, opts.Repository)
+	if err != nil {
+		return nil, err
+	}
+
+	if repository.connector == nil {
+		return nil, errors.New("the job queue requires a connector")
+	}
+
+	queue := &JobQueue[T]{
+		repository: repository,
+		options:    opts,
+	}
+
+	if err := queue.createIndexes(); err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+func (queue *JobQueue[T]) GetRepository() *MongoRepository[T] {
+	return queue.repository
+}
+
+func (queue *JobQueue[T]) createIndexes() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := queue.repository.getCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "priority", Value: -1}, {Key: "runAt", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "leaseUntil", Value: 1}}},
+	})
+	return err
+}
+
+// Enqueue stores the job as pending and returns its id.
+func (queue *JobQueue[T]) Enqueue(doc T, opts EnqueueOptions) (interface{}, error) {
+	document, err := queue.repository.fixInsert(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	runAt := opts.RunAt
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+
+	document["status"] = JobPending
+	document["priority"] = opts.Priority
+	document["runAt"] = runAt
+	document["attempts"] = 0
+	delete(document, "owner")
+	delete(document, "leaseUntil")
+	delete(document, "lastError")
+	delete(document, "finished")
+
+	var insertedID interface{}
+	err = queue.repository.write(nil, queue.repository.queryOptions(nil), func(ctx context.Context, collection *mongo.Collection) error {
+		result, err := collection.InsertOne(ctx, document)
+		if err != nil {
+			return err
+		}
+
+		insertedID = result.InsertedID
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return insertedID, nil
+}
+
+// Claim leases the next runnable job to the owner, or returns nil when there is none.
+func (queue *JobQueue[T]) Claim(owner string) (*T, error) {
+	if owner == "" {
+		return nil, errors.New("the job owner is required")
+	}
+
+	now := time.Now()
+	query := queue.repository.fixQuery(bson.M{
+		"$or": bson.A{
+			bson.M{"status": JobPending, "runAt": bson.M{"$lte": now}},
+			bson.M{
+				"status":     JobRunning,
+				"leaseUntil": bson.M{"$lte": now},
+				"attempts":   bson.M{"$lt": queue.options.MaxAttempts},
+			},
+		},
+	})
+
+	update, err := queue.repository.fixUpdate(bson.M{
+		"$set": bson.M{
+			"status":     JobRunning,
+			"owner":      owner,
+			"leaseUntil": now.Add(queue.options.VisibilityTimeout),
+		},
+		"$inc": bson.M{"attempts": 1},
+	}, UpdateOptions{}, UpdateOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	after := options.After
+	receiver := new(T)
+	err = queue.repository.write(nil, queue.repository.queryOptions(nil), func(ctx context.Context, collection *mongo.Collection) error {
+		return collection.FindOneAndUpdate(ctx, query, update, &options.FindOneAndUpdateOptions{
+			Sort:           bson.D{{Key: "priority", Value: -1}, {Key: "runAt", Value: 1}},
+			ReturnDocument: &after,
+		}).Decode(receiver)
+	})
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return receiver, nil
+}
+
+// Heartbeat extends the lease of a running job.
+func (queue *JobQueue[T]) Heartbeat(id interface{}, owner string) error {
+	return queue.updateLeased(id, owner, bson.M{
+		"$set": bson.M{"leaseUntil": time.Now().Add(queue.options.VisibilityTimeout)},
+	})
+}
+
+// Complete marks a running job as completed.
+func (queue *JobQueue[T]) Complete(id interface{}, owner string) error {
+	return queue.updateLeased(id, owner, bson.M{
+		"$set":   bson.M{"status": JobCompleted, "finished": time.Now()},
+		"$unset": bson.M{"owner": "", "leaseUntil": "", "lastError": ""},
+	})
+}
+
+// Fail releases a running job to be retried with a backoff, or moves it to the dead state.
+func (queue *JobQueue[T]) Fail(id interface{}, owner string, jobErr error) error {
+	query, err := queue.leaseQuery(id, owner)
+	if err != nil {
+		return err
+	}
+
+	lastError := ""
+	if jobErr != nil {
+		lastError = jobErr.Error()
+	}
+
+	now := time.Now()
+	dead := bson.M{"$gte": bson.A{"$attempts", queue.options.MaxAttempts}}
+
+	// exponentialBackoff in milliseconds
+	backoff := bson.M{"$min": bson.A{
+		queue.options.MaxBackoff.Milliseconds(),
+		bson.M{"$multiply": bson.A{
+			queue.options.MinBackoff.Milliseconds(),
+			bson.M{"$pow": bson.A{2, bson.M{"$subtract": bson.A{bson.M{"$max": bson.A{"$attempts", 1}}, 1}}}},
+		}},
+	}}
+
+	set := bson.M{
+		"lastError": lastError,
+		"status":    bson.M{"$cond": bson.A{dead, JobDead, JobPending}},
+		"finished":  bson.M{"$cond": bson.A{dead, now, "$$REMOVE"}},
+		"runAt":     bson.M{"$cond": bson.A{dead, "$runAt", bson.M{"$add": bson.A{now, backoff}}}},
+	}
+	if queue.repository.Options.Modified {
+		set["modified"] = now
+	}
+
+	pipeline := bson.A{
+		bson.M{"$set": set},
+		bson.M{"$unset": bson.A{"owner", "leaseUntil"}},
+	}
+
+	after := options.After
+	var job JobFields
+	err = queue.repository.write(nil, queue.repository.queryOptions(nil), func(ctx context.Context, collection *mongo.Collection) error {
+		return collection.FindOneAndUpdate(ctx, query, pipeline, &options.FindOneAndUpdateOptions{
+			ReturnDocument: &after,
+		}).Decode(&job)
+	})
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrJobLeaseLost
+		}
+		return err
+	}
+
+	logger := queue.repository.datasource.getLogger()
+	if job.Status == JobDead {
+		logger.Error("job failed", "model", queue.repository.schema.Name, "id", id, "attempts", job.Attempts, "error", lastError)
+	} else {
+		logger.Warn("job failed, retrying", "model", queue.repository.schema.Name, "id", id, "attempts", job.Attempts,
+			"runAt", job.RunAt, "error", lastError)
+	}
+
+	return nil
+}
+
+// ReapExpired moves the jobs whose lease expired after their last attempt to the dead state.
+func (queue *JobQueue[T]) ReapExpired() (int64, error) {
+	query := queue.repository.fixQuery(bson.M{
+		"status":     JobRunning,
+		"leaseUntil": bson.M{"$lte": time.Now()},
+		"attempts":   bson.M{"$gte": queue.options.MaxAttempts},
+	})
+
+	update, err := queue.repository.fixUpdate(bson.M{
+		"$set":   bson.M{"status": JobDead, "finished": time.Now(), "lastError": "lease expired"},
+		"$unset": bson.M{"owner": "", "leaseUntil": ""},
+	}, UpdateOptions{}, UpdateOptions{})
+	if err != nil {
+		return 0, err
+	}
+
+	var modifiedCount int64
+	err = queue.repository.write(nil, queue.repository.queryOptions(nil), func(ctx context.Context, collection *mongo.Collection) error {
+		result, err := collection.UpdateMany(ctx, query, update)
+		if err != nil {
+			return err
+		}
+
+		modifiedCount = result.ModifiedCount
+		return nil
+	})
+
+	return modifiedCount, err
+}
+
+func (queue *JobQueue[T]) updateLeased(id interface{}, owner string, update bson.M) error {
+	query, err := queue.leaseQuery(id, owner)
+	if err != nil {
+		return err
+	}
+
+	fixedUpdate, err := queue.repository.fixUpdate(update, UpdateOptions{}, UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	return queue.repository.write(nil, queue.repository.queryOptions(nil), func(ctx context.Context, collection *mongo.Collection) error {
+		result, err := collection.UpdateOne(ctx, query, fixedUpdate)
+		if err != nil {
+			return err
+		}
+
+		if result.MatchedCount == 0 {
+			return ErrJobLeaseLost
+		}
+		return nil
+	})
+}
+
+// leaseQuery matches the job only while it is running under the given owner.
+func (queue *JobQueue[T]) leaseQuery(id interface{}, owner string) (bson.M, error) {
+	parsedFilter, err := lbFilterQuery(lbq.Filter{Where: lbq.Where{"id": id}}, queue.repository.schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return queue.repository.fixQuery(bson.M{
+		"$and": bson.A{
+			parsedFilter.Where,
+			bson.M{"status": JobRunning, "owner": owner},
+		},
+	}), nil
+}
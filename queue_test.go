@@ -0,0 +1,120 @@
+package go_mongo_repository
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/xompass/lbq"
+)
+
+func TestJobQueue(t *testing.T) {
+	datasource := testDatasource(t)
+	queue, err := NewJobQueue[JobTest](datasource, JobQueueOptions{
+		VisibilityTimeout: 200 * time.Millisecond,
+		MaxAttempts:       2,
+		MinBackoff:        50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, job := range []struct {
+		name string
+		opts EnqueueOptions
+	}{
+		{name: "low"},
+		{name: "high", opts: EnqueueOptions{Priority: 10}},
+		{name: "later", opts: EnqueueOptions{Priority: 100, RunAt: time.Now().Add(time.Hour)}},
+	} {
+		if _, err := queue.Enqueue(JobTest{Name: job.name}, job.opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claim := func(owner string, expected string) *JobTest {
+		t.Helper()
+		job, err := queue.Claim(owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected == "" {
+			if job != nil {
+				t.Fatalf("expected no job, got %s", job.Name)
+			}
+			return nil
+		}
+		if job == nil || job.Name != expected || job.Status != JobRunning || job.Owner != owner {
+			t.Fatalf("expected the job %s, got %+v", expected, job)
+		}
+		return job
+	}
+
+	// By priority, and not before the run time
+	high := claim("w1", "high")
+	low := claim("w2", "low")
+	claim("w3", "")
+
+	if err := queue.Heartbeat(high.Id, "w2"); err != ErrJobLeaseLost {
+		t.Fatalf("only the owner can extend the lease, got %v", err)
+	}
+	if err := queue.Heartbeat(high.Id, "w1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := queue.Fail(low.Id, "w2", errors.New("timeout")); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Fail(low.Id, "w2", errors.New("timeout")); err != ErrJobLeaseLost {
+		t.Fatalf("a released job can not fail twice, got %v", err)
+	}
+
+	failed, err := queue.GetRepository().FindById(low.Id, lbq.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.Status != JobPending || failed.Attempts != 1 || failed.LastError != "timeout" || failed.Owner != "" ||
+		failed.RunAt == nil || !failed.RunAt.After(time.Now()) {
+		t.Fatalf("the failed job must be scheduled again, got %+v", failed)
+	}
+
+	// The lease of high expires, so it is claimed again before low
+	time.Sleep(250 * time.Millisecond)
+	stolen := claim("w4", "high")
+	if stolen.Attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", stolen.Attempts)
+	}
+	if err := queue.Complete(high.Id, "w1"); err != ErrJobLeaseLost {
+		t.Fatalf("the previous owner lost the lease, got %v", err)
+	}
+
+	// The last attempt fails
+	if err := queue.Fail(high.Id, "w4", errors.New("crash")); err != nil {
+		t.Fatal(err)
+	}
+	dead, err := queue.GetRepository().FindById(high.Id, lbq.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead.Status != JobDead || dead.Finished == nil || dead.Attempts != 2 {
+		t.Fatalf("the job must be dead after the max attempts, got %+v", dead)
+	}
+
+	// The lease of the last attempt of low expires: it is not claimed again, but reaped
+	claim("w5", "low")
+	time.Sleep(250 * time.Millisecond)
+	claim("w6", "")
+
+	reaped, err := queue.ReapExpired()
+	if err != nil || reaped != 1 {
+		t.Fatalf("expected 1 reaped job, got %d, %v", reaped, err)
+	}
+
+	dead, err = queue.GetRepository().FindById(low.Id, lbq.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dead.Status != JobDead || dead.LastError != "lease expired" {
+		t.Fatalf("the expired job must be dead, got %+v", dead)
+	}
+}
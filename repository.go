@@ -3,14 +3,17 @@ package go_mongo_repository
 import (
 	"context"
 	"errors"
-	"fmt"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/xompass/lbq"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 type IModel interface {
@@ -28,16 +31,45 @@ type FieldDetails struct {
 }
 
 type MongoRepository[T IModel] struct {
-	Options    RepositoryOptions
-	collection *mongo.Collection
-	schema     *Schema
-	connector  *MongoConnector
+	Options        RepositoryOptions
+	collectionName string
+	schema         *Schema
+	connector      *MongoConnector
+	datasource     *MongoDatasource
+	events         *pendingEvents // Events of a WithEvents copy, enqueued by its first write
+	bulkhead       chan struct{}  // Holds a token per running operation when MaxInFlight is set
+
+	// Called before and after each write, e.g. by a CachedRepository to invalidate its entries. Shared with the
+	// WithEvents copies
+	writeHooks *writeHooks
+}
+
+type writeHook func(operation *Operation, queryOptions *QueryOptions)
+
+// writeHooks is the list of write hooks of a repository and its copies. Hooks can be added at any time.
+type writeHooks struct {
+	mutex sync.RWMutex
+	hooks []writeHook
 }
 
 type RepositoryOptions struct {
 	Created  bool
 	Modified bool
 	Deleted  bool
+	Outbox   *Outbox // Outbox used by the repositories returned by WithEvents
+
+	CreateIndexes bool               // Create the indexes declared with the lb_index tag in NewRepository
+	Collation     *options.Collation // Default collation of the queries and the indexes
+	FilterPolicy  *FilterPolicy      // Restrictions of the untrusted filters
+
+	// Read preference of Find, FindOne, Count, Exists and Aggregate. Defaults to the DefaultReadPreference of the
+	// connector. Writes always go to the primary
+	ReadPreference *readpref.ReadPref
+	WriteConcern   *writeconcern.WriteConcern // Write concern of the writes, defaults to the one of the connector
+
+	// Operations of the repository that run at once, retries included. The next ones fail with ErrTooManyInFlight.
+	// Zero is unlimited
+	MaxInFlight int
 }
 
 type UpdateOptions struct {
@@ -50,6 +82,9 @@ func NewRepository[T IModel](ds *MongoDatasource, options RepositoryOptions) (*M
 	collectionName := instance.GetTableName()
 
 	schema := NewSchema(instance)
+	for _, parseErr := range schema.ParseErrors {
+		ds.getLogger().Error("schema field parse error", "model", schema.Name, "error", parseErr)
+	}
 
 	err := ds.RegisterModel(instance)
 	if err != nil {
@@ -59,63 +94,161 @@ func NewRepository[T IModel](ds *MongoDatasource, options RepositoryOptions) (*M
 	connector, _ := ds.GetModelConnector(instance)
 	if connector == nil {
 		return &MongoRepository[T]{
-			Options:    options,
-			collection: nil,
-			schema:     schema,
-			connector:  nil,
+			Options:        options,
+			collectionName: collectionName,
+			schema:         schema,
+			connector:      nil,
+			datasource:     ds,
+			writeHooks:     &writeHooks{},
 		}, nil
 	}
 
-	connectorOpts := connector.GetOptions()
-	client := connector.GetDriver()
-
-	databaseName := connectorOpts.Database
-	if databaseName == "" {
+	if connector.GetOptions().Database == "" {
 		return nil, errors.New("database name is required")
 	}
 
 	repository := &MongoRepository[T]{
-		Options:    options,
-		collection: client.Database(databaseName).Collection(collectionName),
-		schema:     schema,
-		connector:  connector,
+		Options:        options,
+		collectionName: collectionName,
+		schema:         schema,
+		connector:      connector,
+		datasource:     ds,
+		writeHooks:     &writeHooks{},
+	}
+
+	if options.MaxInFlight > 0 {
+		repository.bulkhead = make(chan struct{}, options.MaxInFlight)
+	}
+
+	if options.CreateIndexes {
+		if err := repository.CreateIndexes(); err != nil {
+			return nil, err
+		}
 	}
 
 	return repository, nil
 }
 
 func (repository *MongoRepository[T]) GetCollection() *mongo.Collection {
-	return repository.collection
+	return repository.getCollection()
+}
+
+// getCollection returns the collection of the current client of the connector, nil when there is no connector.
+func (repository *MongoRepository[T]) getCollection() *mongo.Collection {
+	if repository.connector == nil {
+		return nil
+	}
+
+	return repository.connector.getCollection(repository.collectionName)
 }
 
 func (repository *MongoRepository[T]) GetSchema() *Schema {
 	return repository.schema
 }
 
-func (repository *MongoRepository[T]) Find(filter lbq.Filter) ([]T, error) {
-	parsedFilter, err := lbFilterQuery(filter, repository.schema)
+// StartCausalSession starts a causally consistent session in the connector of the repository. The calls made with
+// QueryOptions.SetSession read their own writes, even with a secondary read preference.
+func (repository *MongoRepository[T]) StartCausalSession() (mongo.Session, error) {
+	if repository.connector == nil {
+		return nil, errors.New("the repository has no connector")
+	}
+
+	return repository.connector.StartCausalSession()
+}
+
+// WithEvents returns a copy of the repository whose next write also enqueues the events in the outbox, within the
+// same transaction. The events are enqueued once: the writes after the first successful one do not enqueue them,
+// while a failed write leaves them for the next one.
+func (repository *MongoRepository[T]) WithEvents(events ...OutboxEvent) *MongoRepository[T] {
+	clone := *repository
+	clone.events = &pendingEvents{events: append([]OutboxEvent{}, events...)}
+	return &clone
+}
+
+// pendingEvents are the events of a WithEvents copy that were not enqueued yet.
+type pendingEvents struct {
+	mutex  sync.Mutex
+	events []OutboxEvent
+}
+
+// take returns the events and leaves none, so a concurrent write does not enqueue them too. events can be nil.
+func (events *pendingEvents) take() []OutboxEvent {
+	if events == nil {
+		return nil
+	}
+
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	taken := events.events
+	events.events = nil
+	return taken
+}
+
+// restore gives back the events of a failed write.
+func (events *pendingEvents) restore(taken []OutboxEvent) {
+	events.mutex.Lock()
+	defer events.mutex.Unlock()
+
+	events.events = append(taken, events.events...)
+}
+
+func (repository *MongoRepository[T]) Find(filter lbq.Filter, opts ...*QueryOptions) (docs []T, err error) {
+	operation, err := repository.startOperation("Find")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { operation.end(int64(len(docs)), err) }()
+
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
 	if err != nil {
 		return nil, err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	ctx = queryOptions.sessionContext(ctx)
 
 	query := repository.fixQuery(parsedFilter.Where)
-
-	cursor, err := repository.collection.Find(ctx, query, &options.FindOptions{
-		Sort:       parsedFilter.Options.Sort,
-		Limit:      parsedFilter.Options.Limit,
-		Skip:       parsedFilter.Options.Skip,
-		Projection: parsedFilter.Options.Fields,
+	operation.setQuery(query)
+	operation.setFind(parsedFilter.Options.Sort, parsedFilter.Options.Limit, func(ctx context.Context) (*ExplainResult, error) {
+		return repository.explainContext(ctx, repository.findCommand(query, parsedFilter.Options.Sort, queryOptions), ExplainQueryPlanner)
 	})
+	operation.begin()
+
+	if err := repository.checkIndexUsage(query, parsedFilter.Options.Sort, queryOptions); err != nil {
+		return nil, err
+	}
 
+	collection, err := repository.readCollection(queryOptions)
 	if err != nil {
 		return nil, err
 	}
 
 	var receiver []T
-	if err = cursor.All(ctx, &receiver); err != nil {
+	err = repository.retry(ctx, operation, true, func() error {
+		cursor, err := collection.Find(ctx, query, &options.FindOptions{
+			Sort:         parsedFilter.Options.Sort,
+			Limit:        parsedFilter.Options.Limit,
+			Skip:         parsedFilter.Options.Skip,
+			Projection:   parsedFilter.Options.projection(),
+			Collation:    queryOptions.Collation,
+			Hint:         queryOptions.Hint,
+			MaxTime:      queryOptions.MaxTime,
+			Comment:      queryOptions.Comment,
+			AllowDiskUse: queryOptions.AllowDiskUse,
+			BatchSize:    queryOptions.BatchSize,
+		})
+		if err != nil {
+			return err
+		}
+
+		receiver = nil
+		return cursor.All(ctx, &receiver)
+	})
+
+	if err != nil {
 		return nil, err
 	}
 
@@ -125,21 +258,52 @@ func (repository *MongoRepository[T]) Find(filter lbq.Filter) ([]T, error) {
 	return receiver, nil
 }
 
-func (repository *MongoRepository[T]) FindOne(filter lbq.Filter) (*T, error) {
-	parsedFilter, err := lbFilterQuery(filter, repository.schema)
+func (repository *MongoRepository[T]) FindOne(filter lbq.Filter, opts ...*QueryOptions) (doc *T, err error) {
+	operation, err := repository.startOperation("FindOne")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { operation.end(countOf(doc), err) }()
+
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
 	if err != nil {
 		return nil, err
 	}
 	receiver := new(T)
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	ctx = queryOptions.sessionContext(ctx)
 
 	query := repository.fixQuery(parsedFilter.Where)
-	err = repository.collection.FindOne(ctx, query, &options.FindOneOptions{
-		Sort:       parsedFilter.Options.Sort,
-		Skip:       parsedFilter.Options.Skip,
-		Projection: parsedFilter.Options.Fields,
-	}).Decode(receiver)
+	operation.setQuery(query)
+	one := int64(1)
+	operation.setFind(parsedFilter.Options.Sort, &one, func(ctx context.Context) (*ExplainResult, error) {
+		command := append(repository.findCommand(query, parsedFilter.Options.Sort, queryOptions), bson.E{Key: "limit", Value: one})
+		return repository.explainContext(ctx, command, ExplainQueryPlanner)
+	})
+	operation.begin()
+
+	if err := repository.checkIndexUsage(query, parsedFilter.Options.Sort, queryOptions); err != nil {
+		return nil, err
+	}
+
+	collection, err := repository.readCollection(queryOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = repository.retry(ctx, operation, true, func() error {
+		return collection.FindOne(ctx, query, &options.FindOneOptions{
+			Sort:       parsedFilter.Options.Sort,
+			Skip:       parsedFilter.Options.Skip,
+			Projection: parsedFilter.Options.projection(),
+			Collation:  queryOptions.Collation,
+			Hint:       queryOptions.Hint,
+			MaxTime:    queryOptions.MaxTime,
+			Comment:    queryOptions.Comment,
+		}).Decode(receiver)
+	})
 
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -150,131 +314,211 @@ func (repository *MongoRepository[T]) FindOne(filter lbq.Filter) (*T, error) {
 	return receiver, err
 }
 
-func (repository *MongoRepository[T]) FindById(id interface{}, filter lbq.Filter) (*T, error) {
-	if filter.Where == nil || len(filter.Where) == 0 {
-		filter.Where = lbq.Where{"id": id}
-	} else {
-		filter.Where = lbq.Where{
-			"and": lbq.AndOrCondition{
-				lbq.Where{"id": id},
-				filter.Where,
-			},
+func (repository *MongoRepository[T]) FindById(id interface{}, filter lbq.Filter, opts ...*QueryOptions) (*T, error) {
+	return repository.FindOne(filter, append(opts, withId(id))...)
+}
+
+func (repository *MongoRepository[T]) Insert(doc T, opts ...*QueryOptions) (insertedID interface{}, err error) {
+	operation, err := repository.startOperation("Insert")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { operation.end(countOf(insertedID), err) }()
+	operation.begin()
+
+	document, err := repository.fixInsert(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = repository.write(operation, repository.queryOptions(opts), func(ctx context.Context, collection *mongo.Collection) error {
+		insertedResult, err := collection.InsertOne(ctx, document)
+		if err != nil {
+			return err
 		}
+
+		insertedID = insertedResult.InsertedID
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
-	return repository.FindOne(filter)
+	return insertedID, nil
 }
 
-func (repository *MongoRepository[T]) Insert(doc T) (interface{}, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	document, err := repository.fixInsert(doc)
+// InsertMany inserts the documents in order and returns their ids. The insertion stops at the first error.
+func (repository *MongoRepository[T]) InsertMany(docs []T, opts ...*QueryOptions) (insertedIDs []interface{}, err error) {
+	operation, err := repository.startOperation("InsertMany")
 	if err != nil {
 		return nil, err
 	}
+	defer func() { operation.end(int64(len(insertedIDs)), err) }()
+	operation.begin()
+
+	if len(docs) == 0 {
+		return []interface{}{}, nil
+	}
+
+	fixedDocuments := make([]bson.M, 0, len(docs))
+	for _, doc := range docs {
+		document, err := repository.fixInsertFields(doc)
+		if err != nil {
+			return nil, err
+		}
+		fixedDocuments = append(fixedDocuments, document)
+	}
+
+	// A single counter update per sequence for the whole batch
+	if err := repository.assignSequences(fixedDocuments); err != nil {
+		return nil, err
+	}
+
+	documents := make([]interface{}, 0, len(fixedDocuments))
+	for _, document := range fixedDocuments {
+		documents = append(documents, document)
+	}
+
+	err = repository.write(operation, repository.queryOptions(opts), func(ctx context.Context, collection *mongo.Collection) error {
+		insertedResult, err := collection.InsertMany(ctx, documents)
+		if err != nil {
+			return err
+		}
 
-	insertedResult, err := repository.collection.InsertOne(ctx, document)
+		insertedIDs = insertedResult.InsertedIDs
+		return nil
+	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return insertedResult.InsertedID, nil
+	return insertedIDs, nil
 }
 
-func (repository *MongoRepository[T]) Create(doc T) (*T, error) {
-	insertedID, err := repository.Insert(doc)
+func (repository *MongoRepository[T]) Create(doc T, opts ...*QueryOptions) (*T, error) {
+	insertedID, err := repository.Insert(doc, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	return repository.FindById(insertedID, lbq.Filter{})
+	// The document is read from the primary, a secondary may not have it yet
+	return repository.FindById(insertedID, lbq.Filter{}, append(opts, NewQueryOptions().SetReadPreference(readpref.Primary()))...)
 }
 
-func (repository *MongoRepository[T]) FindOneOrCreate(filter lbq.Filter, doc T) (*T, error) {
+func (repository *MongoRepository[T]) FindOneOrCreate(filter lbq.Filter, doc T, opts ...*QueryOptions) (*T, error) {
 	upsert := true
 	after := options.After
 
-	return repository.findOneAnUpdate(filter, doc, &options.FindOneAndUpdateOptions{Upsert: &upsert, ReturnDocument: &after})
+	return repository.findOneAnUpdate("FindOneOrCreate", filter, doc, &options.FindOneAndUpdateOptions{Upsert: &upsert, ReturnDocument: &after}, opts)
 }
 
-func (repository *MongoRepository[T]) Upsert(filter lbq.Filter, update any) error {
-	upsert := true
-	parsedFilter, err := lbFilterQuery(filter, repository.schema)
+func (repository *MongoRepository[T]) Upsert(filter lbq.Filter, update any, opts ...*QueryOptions) (err error) {
+	var count int64
+	operation, err := repository.startOperation("Upsert")
 	if err != nil {
 		return err
 	}
+	defer func() { operation.end(count, err) }()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	upsert := true
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
+	if err != nil {
+		return err
+	}
 
 	fixedUpdate, err := repository.fixUpdate(update, UpdateOptions{}, UpdateOptions{})
 	if err != nil {
 		return err
 	}
 
+	// Checked before the soft delete condition wraps the id of the query
+	operation.idempotent = isIdempotentUpdate(parsedFilter.Where, fixedUpdate)
 	query := repository.fixQuery(parsedFilter.Where)
+	operation.setQuery(query)
+	operation.begin()
 
-	_, err = repository.collection.UpdateOne(ctx, query, fixedUpdate, &options.UpdateOptions{Upsert: &upsert})
-	if err != nil {
-		return err
-	}
+	return repository.write(operation, queryOptions, func(ctx context.Context, collection *mongo.Collection) error {
+		result, err := collection.UpdateOne(ctx, query, fixedUpdate, queryOptions.updateOptions().SetUpsert(upsert))
+		if err != nil {
+			return err
+		}
 
-	return nil
+		count = result.MatchedCount + result.UpsertedCount
+		return nil
+	})
 }
 
-func (repository *MongoRepository[T]) UpdateOne(filter lbq.Filter, update interface{}) error {
-	parsedFilter, err := lbFilterQuery(filter, repository.schema)
+func (repository *MongoRepository[T]) UpdateOne(filter lbq.Filter, update interface{}, opts ...*QueryOptions) (err error) {
+	var count int64
+	operation, err := repository.startOperation("UpdateOne")
 	if err != nil {
 		return err
 	}
+	defer func() { operation.end(count, err) }()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
+	if err != nil {
+		return err
+	}
 
 	fixedUpdate, err := repository.fixUpdate(update, UpdateOptions{}, UpdateOptions{})
 	if err != nil {
 		return err
 	}
 
+	// Checked before the soft delete condition wraps the id of the query
+	operation.idempotent = isIdempotentUpdate(parsedFilter.Where, fixedUpdate)
 	query := repository.fixQuery(parsedFilter.Where)
+	operation.setQuery(query)
+	operation.begin()
 
-	_, err = repository.collection.UpdateOne(ctx, query, fixedUpdate)
-	if err != nil {
-		return err
-	}
+	return repository.write(operation, queryOptions, func(ctx context.Context, collection *mongo.Collection) error {
+		result, err := collection.UpdateOne(ctx, query, fixedUpdate, queryOptions.updateOptions())
+		if err != nil {
+			return err
+		}
 
-	return nil
+		count = result.MatchedCount
+		return nil
+	})
 }
 
-func (repository *MongoRepository[T]) UpdateById(id interface{}, update interface{}) error {
-	return repository.UpdateOne(lbq.Filter{
-		Where: lbq.Where{"id": id},
-	}, update)
+func (repository *MongoRepository[T]) UpdateById(id interface{}, update interface{}, opts ...*QueryOptions) error {
+	return repository.UpdateOne(lbq.Filter{}, update, append(opts, withId(id))...)
 }
 
-func (repository *MongoRepository[T]) FindOneAnUpdate(filter lbq.Filter, update interface{}) (*T, error) {
-	return repository.findOneAnUpdate(filter, update)
+func (repository *MongoRepository[T]) FindOneAnUpdate(filter lbq.Filter, update interface{}, opts ...*QueryOptions) (*T, error) {
+	return repository.findOneAnUpdate("FindOneAnUpdate", filter, update, nil, opts)
 }
 
-func (repository *MongoRepository[T]) findOneAnUpdate(filter lbq.Filter, update interface{}, opts ...*options.FindOneAndUpdateOptions) (*T, error) {
-	parsedFilter, err := lbFilterQuery(filter, repository.schema)
+func (repository *MongoRepository[T]) findOneAnUpdate(operationName string, filter lbq.Filter, update interface{}, updateOptions *options.FindOneAndUpdateOptions, opts []*QueryOptions) (doc *T, err error) {
+	operation, err := repository.startOperation(operationName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { operation.end(countOf(doc), err) }()
+
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
 	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
 
-	var updateOptions *options.FindOneAndUpdateOptions
 	setCreated := false
-	if len(opts) > 0 {
-		updateOptions = opts[0]
-		setCreated = *updateOptions.Upsert
+	if updateOptions != nil {
+		setCreated = updateOptions.Upsert != nil && *updateOptions.Upsert
 	} else {
 		updateOptions = &options.FindOneAndUpdateOptions{}
 	}
 
+	updateOptions.Collation = queryOptions.Collation
+	updateOptions.Hint = queryOptions.Hint
+	updateOptions.MaxTime = queryOptions.MaxTime
+	updateOptions.Comment = queryOptions.comment()
 	updateOptions.Projection = filter.Fields
 	if updateOptions.ReturnDocument == nil {
 		afterUpdate := options.After
@@ -287,11 +531,14 @@ func (repository *MongoRepository[T]) findOneAnUpdate(filter lbq.Filter, update
 	}
 
 	query := repository.fixQuery(parsedFilter.Where)
+	operation.setQuery(query)
+	operation.begin()
 
 	receiver := new(T)
-	err = repository.collection.FindOneAndUpdate(ctx, query, fixedUpdate, updateOptions).Decode(receiver)
+	err = repository.write(operation, queryOptions, func(ctx context.Context, collection *mongo.Collection) error {
+		return collection.FindOneAndUpdate(ctx, query, fixedUpdate, updateOptions).Decode(receiver)
+	})
 
-	fmt.Println(receiver)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return nil, nil
@@ -301,13 +548,18 @@ func (repository *MongoRepository[T]) findOneAnUpdate(filter lbq.Filter, update
 	return receiver, err
 }
 
-func (repository *MongoRepository[T]) UpdateMany(filter lbq.Filter, update interface{}) (int64, error) {
-	parsedFilter, err := lbFilterQuery(filter, repository.schema)
+func (repository *MongoRepository[T]) UpdateMany(filter lbq.Filter, update interface{}, opts ...*QueryOptions) (modifiedCount int64, err error) {
+	operation, err := repository.startOperation("UpdateMany")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { operation.end(modifiedCount, err) }()
+
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
 	if err != nil {
 		return 0, err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
 
 	fixedUpdate, err := repository.fixUpdate(update, UpdateOptions{}, UpdateOptions{})
 	if err != nil {
@@ -315,35 +567,131 @@ func (repository *MongoRepository[T]) UpdateMany(filter lbq.Filter, update inter
 	}
 
 	query := repository.fixQuery(parsedFilter.Where)
+	operation.setQuery(query)
+	operation.begin()
+
+	err = repository.write(operation, queryOptions, func(ctx context.Context, collection *mongo.Collection) error {
+		result, err := collection.UpdateMany(ctx, query, fixedUpdate, queryOptions.updateOptions())
+		if err != nil {
+			return err
+		}
 
-	result, err := repository.collection.UpdateMany(ctx, query, fixedUpdate)
+		modifiedCount = result.ModifiedCount
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	return result.ModifiedCount, nil
+	return modifiedCount, nil
 }
 
-func (repository *MongoRepository[T]) Count(filter lbq.Filter) (int64, error) {
-	parsedFilter, err := lbFilterQuery(filter, repository.schema)
+func (repository *MongoRepository[T]) Count(filter lbq.Filter, opts ...*QueryOptions) (count int64, err error) {
+	operation, err := repository.startOperation("Count")
+	if err != nil {
+		return 0, err
+	}
+	defer func() { operation.end(count, err) }()
+
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
 	if err != nil {
 		return 0, err
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	ctx = queryOptions.sessionContext(ctx)
 
 	query := repository.fixQuery(parsedFilter.Where)
+	operation.setQuery(query)
+	operation.setFind(nil, nil, func(ctx context.Context) (*ExplainResult, error) {
+		return repository.explainContext(ctx, repository.findCommand(query, nil, queryOptions), ExplainQueryPlanner)
+	})
+	operation.begin()
+
+	if hasNear(query) {
+		return 0, errors.New("invalid where parameter. near is not allowed in count, use geoWithin instead")
+	}
+
+	if err := repository.checkIndexUsage(query, nil, queryOptions); err != nil {
+		return 0, err
+	}
+
+	collection, err := repository.readCollection(queryOptions)
+	if err != nil {
+		return 0, err
+	}
+
+	err = repository.retry(ctx, operation, true, func() error {
+		count, err = collection.CountDocuments(ctx, query, &options.CountOptions{
+			Collation: queryOptions.Collation,
+			Hint:      queryOptions.Hint,
+			MaxTime:   queryOptions.MaxTime,
+			Comment:   queryOptions.Comment,
+		})
+		return err
+	})
+
+	return count, err
+}
+
+// Aggregate runs the pipeline and decodes the results into receiver, which must be a pointer to a slice. The soft
+// deleted documents are excluded before the first stage.
+func (repository *MongoRepository[T]) Aggregate(pipeline []bson.M, receiver interface{}, opts ...*QueryOptions) (err error) {
+	operation, err := repository.startOperation("Aggregate")
+	if err != nil {
+		return err
+	}
+	defer func() { operation.end(countOf(receiver), err) }()
+	operation.begin()
+
+	queryOptions := repository.queryOptions(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ctx = queryOptions.sessionContext(ctx)
+
+	stages := make([]bson.M, 0, len(pipeline)+1)
+	if repository.Options.Deleted {
+		stages = append(stages, bson.M{"$match": getSoftDeleteQuery(bson.M{})})
+	}
+	stages = append(stages, pipeline...)
+
+	collection, err := repository.readCollection(queryOptions)
+	if err != nil {
+		return err
+	}
+
+	writes := hasWriteStage(pipeline)
+	if writes {
+		repository.notifyWrite(operation, queryOptions)
+		defer repository.notifyWrite(operation, queryOptions)
+	}
+
+	// A pipeline that writes its results is not retried
+	return repository.retry(ctx, operation, !writes, func() error {
+		cursor, err := collection.Aggregate(ctx, stages, &options.AggregateOptions{
+			Collation:    queryOptions.Collation,
+			Hint:         queryOptions.Hint,
+			MaxTime:      queryOptions.MaxTime,
+			Comment:      queryOptions.Comment,
+			AllowDiskUse: queryOptions.AllowDiskUse,
+			BatchSize:    queryOptions.BatchSize,
+		})
+		if err != nil {
+			return err
+		}
 
-	return repository.collection.CountDocuments(ctx, query)
+		return cursor.All(ctx, receiver)
+	})
 }
 
-func (repository *MongoRepository[T]) Exists(id interface{}) (bool, error) {
+func (repository *MongoRepository[T]) Exists(id interface{}, opts ...*QueryOptions) (bool, error) {
 	doc, err := repository.FindOne(lbq.Filter{
-		Where: lbq.Where{"id": id},
 		Fields: map[string]bool{
 			"_id": true,
 		},
-	})
+	}, append(opts, withId(id))...)
 	if err != nil {
 		return false, err
 	}
@@ -355,68 +703,172 @@ func (repository *MongoRepository[T]) Exists(id interface{}) (bool, error) {
 	return false, nil
 }
 
-func (repository *MongoRepository[T]) DeleteOne(filter lbq.Filter) error {
-	parsedFilter, err := lbFilterQuery(filter, repository.schema)
+func (repository *MongoRepository[T]) DeleteOne(filter lbq.Filter, opts ...*QueryOptions) (err error) {
+	operation, err := repository.startOperation("DeleteOne")
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			operation.end(0, err)
+		} else {
+			operation.end(1, nil)
+		}
+	}()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
+	if err != nil {
+		return err
+	}
 
 	query := repository.fixQuery(parsedFilter.Where)
-	if repository.Options.Deleted {
-		result, err := repository.collection.UpdateOne(ctx, query, bson.M{"$currentDate": bson.M{"deleted": true}})
+	operation.setQuery(query)
+	operation.begin()
+
+	return repository.write(operation, queryOptions, func(ctx context.Context, collection *mongo.Collection) error {
+		if repository.Options.Deleted {
+			result, err := collection.UpdateOne(ctx, query, bson.M{"$currentDate": bson.M{"deleted": true}}, queryOptions.updateOptions())
+			if err != nil {
+				return err
+			}
+			if result.MatchedCount == 0 {
+				return errors.New("no documents founds")
+			}
+			return nil
+		}
+
+		result, err := collection.DeleteOne(ctx, query, queryOptions.deleteOptions())
 		if err != nil {
 			return err
 		}
-		if result.MatchedCount == 0 {
+		if result.DeletedCount == 0 {
 			return errors.New("no documents founds")
 		}
+
 		return nil
-	}
+	})
+}
 
-	result, err := repository.collection.DeleteOne(ctx, query)
+func (repository *MongoRepository[T]) DeleteById(id interface{}, opts ...*QueryOptions) error {
+	return repository.DeleteOne(lbq.Filter{}, append(opts, withId(id))...)
+}
+
+func (repository *MongoRepository[T]) DeleteMany(filter lbq.Filter, opts ...*QueryOptions) (count int64, err error) {
+	operation, err := repository.startOperation("DeleteMany")
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if result.DeletedCount == 0 {
-		return errors.New("no documents founds")
+	defer func() { operation.end(count, err) }()
+
+	queryOptions := repository.queryOptions(opts)
+	parsedFilter, err := repository.parseFilter(filter, queryOptions)
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
-}
+	query := repository.fixQuery(parsedFilter.Where)
+	operation.setQuery(query)
+	operation.begin()
 
-func (repository *MongoRepository[T]) DeleteById(id interface{}) error {
-	return repository.DeleteOne(lbq.Filter{
-		Where: lbq.Where{"id": id},
+	err = repository.write(operation, queryOptions, func(ctx context.Context, collection *mongo.Collection) error {
+		if repository.Options.Deleted {
+			result, err := collection.UpdateMany(ctx, query, bson.M{"$currentDate": bson.M{"deleted": true}}, queryOptions.updateOptions())
+			if err != nil {
+				return err
+			}
+			count = result.ModifiedCount
+			return nil
+		}
+
+		result, err := collection.DeleteMany(ctx, query, queryOptions.deleteOptions())
+		if err != nil {
+			return err
+		}
+		count = result.DeletedCount
+		return nil
 	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
 }
 
-func (repository *MongoRepository[T]) DeleteMany(filter lbq.Filter) (int64, error) {
-	parsedFilter, err := lbFilterQuery(filter, repository.schema)
+// write runs fn with the collection and session of the options, and within the outbox transaction when the
+// repository has events. The write concern of the options is ignored within the transaction. fn is retried
+// according to the retry policy, unless it runs in a session, whose transaction must be retried as a whole.
+// operation can be nil.
+func (repository *MongoRepository[T]) write(operation *Operation, queryOptions *QueryOptions, fn func(ctx context.Context, collection *mongo.Collection) error) error {
+	collection, err := repository.writeCollection(queryOptions)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	query := repository.fixQuery(parsedFilter.Where)
-	if repository.Options.Deleted {
-		result, err := repository.collection.UpdateMany(ctx, query, bson.M{"$currentDate": bson.M{"deleted": true}})
-		if err != nil {
-			return 0, err
+	ctx = queryOptions.sessionContext(ctx)
+
+	repository.notifyWrite(operation, queryOptions)
+	defer repository.notifyWrite(operation, queryOptions)
+
+	events := repository.events.take()
+	if len(events) == 0 {
+		if queryOptions != nil && queryOptions.Session != nil {
+			return repository.guard(func() error {
+				return fn(ctx, collection)
+			})
 		}
-		return result.ModifiedCount, nil
+
+		idempotent := operation != nil && operation.idempotent
+		return repository.retry(ctx, operation, idempotent, func() error {
+			return fn(ctx, collection)
+		})
+	}
+
+	if repository.Options.Outbox == nil {
+		repository.events.restore(events)
+		return errors.New("the repository has events but no outbox configured")
 	}
 
-	result, err := repository.collection.DeleteMany(ctx, query)
+	err = repository.guard(func() error {
+		return repository.Options.Outbox.transaction(ctx, repository.connector, events, func(ctx context.Context) error {
+			return fn(ctx, collection)
+		})
+	})
 	if err != nil {
-		return 0, err
+		repository.events.restore(events)
+	}
+
+	return err
+}
+
+// addWriteHook registers the hook in the repository and its WithEvents copies, including the existing ones.
+func (repository *MongoRepository[T]) addWriteHook(hook writeHook) {
+	// Only the repositories built without NewRepository have no list, they have no copies yet
+	if repository.writeHooks == nil {
+		repository.writeHooks = &writeHooks{}
 	}
 
-	return result.DeletedCount, nil
+	repository.writeHooks.mutex.Lock()
+	defer repository.writeHooks.mutex.Unlock()
+
+	repository.writeHooks.hooks = append(repository.writeHooks.hooks, hook)
+}
+
+func (repository *MongoRepository[T]) notifyWrite(operation *Operation, queryOptions *QueryOptions) {
+	if repository.writeHooks == nil {
+		return
+	}
+
+	repository.writeHooks.mutex.RLock()
+	hooks := repository.writeHooks.hooks
+	repository.writeHooks.mutex.RUnlock()
+
+	for _, hook := range hooks {
+		hook(operation, queryOptions)
+	}
 }
 
 func (repository *MongoRepository[T]) fixQuery(query bson.M) bson.M {
@@ -542,6 +994,20 @@ func (repository *MongoRepository[T]) fixUpdate(update interface{}, updateDelete
 }
 
 func (repository *MongoRepository[T]) fixInsert(doc interface{}) (bson.M, error) {
+	document, err := repository.fixInsertFields(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := repository.assignSequences([]bson.M{document}); err != nil {
+		return nil, err
+	}
+
+	return document, nil
+}
+
+// fixInsertFields sets the fields managed by the repository, except the sequences.
+func (repository *MongoRepository[T]) fixInsertFields(doc interface{}) (bson.M, error) {
 	document, err := toBsonMap(doc)
 	if err != nil {
 		return nil, err
@@ -562,6 +1028,52 @@ func (repository *MongoRepository[T]) fixInsert(doc interface{}) (bson.M, error)
 	return document, nil
 }
 
+// assignSequences sets the next counter values on the lb_seq fields that have no value, in the order of the
+// documents. The values of each sequence are reserved with a single NextSequenceRange.
+func (repository *MongoRepository[T]) assignSequences(documents []bson.M) error {
+	if len(repository.schema.SequenceFields) == 0 {
+		return nil
+	}
+
+	if repository.datasource == nil {
+		return errors.New("sequence fields require a datasource")
+	}
+
+	// The counters are shared by the repositories of every connector, as in NextSequence
+	connector, err := repository.datasource.getCountersConnector()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, field := range repository.schema.SequenceFields {
+		var missing []bson.M
+		for _, document := range documents {
+			if value, ok := document[field.BsonName]; ok && !isZeroValue(value) {
+				continue
+			}
+			missing = append(missing, document)
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+
+		first, _, err := connector.nextSequenceRange(ctx, field.Sequence, int64(len(missing)))
+		if err != nil {
+			return err
+		}
+
+		for i, document := range missing {
+			document[field.BsonName] = first + int64(i)
+		}
+	}
+
+	return nil
+}
+
 func getSoftDeleteQuery(query bson.M) bson.M {
 	return bson.M{
 		"$and": []interface{}{
@@ -571,6 +1083,14 @@ func getSoftDeleteQuery(query bson.M) bson.M {
 	}
 }
 
+func isZeroValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	return reflect.ValueOf(value).IsZero()
+}
+
 func toBsonMap(v interface{}) (doc bson.M, err error) {
 	data, err := bson.Marshal(v)
 	if err != nil {
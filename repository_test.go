@@ -1,9 +1,12 @@
 package go_mongo_repository
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/xompass/lbq"
 )
@@ -24,6 +27,44 @@ func initializeDataSource() (*MongoDatasource, error) {
 	return &mongoDatasource, nil
 }
 
+// testServerErr is the connection error of the first testDatasource, so the next tests are skipped at once.
+var testServerErr error
+
+// testDatasource connects the "db" connector to the server of MONGO_TEST_URI, a local one by default, with a
+// database of its own that is dropped at the end of the test. The test is skipped when there is no server.
+func testDatasource(t *testing.T) *MongoDatasource {
+	t.Helper()
+
+	if testServerErr != nil {
+		t.Skipf("MongoDB is not available: %v", testServerErr)
+	}
+
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		uri = "mongodb://localhost:27017"
+	}
+
+	datasource := &MongoDatasource{}
+	opts := MongoConnectorOpts{Database: fmt.Sprintf("go_mongo_repository_test_%d", time.Now().UnixNano())}
+	opts.ClientOptions.ApplyURI(uri).SetServerSelectionTimeout(2 * time.Second)
+
+	if _, err := datasource.NewConnector("db", opts); err != nil {
+		testServerErr = err
+		t.Skipf("MongoDB is not available: %v", err)
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		connector, _ := datasource.GetConnector("db")
+		_ = connector.GetDriver().Database(opts.Database).Drop(ctx)
+		datasource.Destroy()
+	})
+
+	return datasource
+}
+
 func createRepository() (*MongoRepository[AssetTest], error) {
 	mDatasource, err := initializeDataSource()
 	if err != nil {
@@ -56,10 +56,10 @@ type AssetTest struct {
 	PersistedModelWithDeleted `bson:",inline" json:",inline"`
 
 	Type              *string             `bson:"type,omitempty" json:"type,omitempty"`
-	Name              *string             `bson:"name,omitempty" json:"name,omitempty"`
+	Name              *string             `bson:"name,omitempty" json:"name,omitempty" lb_index:"text,weight=10"`
 	Icon              *string             `bson:"icon,omitempty" json:"icon,omitempty"`
-	Description       *string             `bson:"description,omitempty" json:"description,omitempty"`
-	ReferenceId       *string             `bson:"referenceId,omitempty" json:"referenceId,omitempty"`
+	Description       *string             `bson:"description,omitempty" json:"description,omitempty" lb_index:"text"`
+	ReferenceId       *string             `bson:"referenceId,omitempty" json:"referenceId,omitempty" lb_index:"asc,unique,sparse"`
 	Uri               *string             `bson:"uri,omitempty" json:"uri,omitempty"`
 	Path              []string            `bson:"path,omitempty" json:"path,omitempty"`
 	Requested         *time.Time          `bson:"requested,omitempty" json:"requested,omitempty"`
@@ -70,9 +70,16 @@ type AssetTest struct {
 	AssetWizardTypeId *primitive.ObjectID `bson:"assetWizardTypeId,omitempty" json:"assetWizardTypeId,omitempty"`
 	CustomerId        *primitive.ObjectID `bson:"customerId,omitempty" json:"customerId,omitempty"`
 	ProjectId         *primitive.ObjectID `bson:"projectId,omitempty" json:"projectId,omitempty"`
+	Measurements      []MeasurementTest   `bson:"measurements,omitempty" json:"measurements,omitempty"`
 	Asset             *AssetTest          `bson:"-" json:"asset,omitempty"`
 }
 
+type MeasurementTest struct {
+	Name     *string             `bson:"name,omitempty" json:"name,omitempty"`
+	Value    *float64            `bson:"value,omitempty" json:"value,omitempty"`
+	SensorId *primitive.ObjectID `bson:"sensorId,omitempty" json:"sensorId,omitempty"`
+}
+
 type Sensor struct {
 	PersistedModelWithId      `bson:",inline" json:",inline"`
 	PersistedModelWithDates   `bson:",inline" json:",inline"`
@@ -91,6 +98,15 @@ type Sensor struct {
 	TemplateId         *primitive.ObjectID `bson:"templateId,omitempty" json:"templateId,omitempty"`
 } // @name Sensor
 
+type WorkOrderTest struct {
+	PersistedModelWithId    `bson:",inline" json:",inline"`
+	PersistedModelWithDates `bson:",inline" json:",inline"`
+
+	Number      int64   `bson:"number,omitempty" json:"number,omitempty" lb_seq:""`
+	LegacyCode  int64   `bson:"legacyCode,omitempty" json:"legacyCode,omitempty" lb_seq:"legacy"`
+	Description *string `bson:"description,omitempty" json:"description,omitempty"`
+}
+
 func (a AssetTest) GetModelName() string {
 	return "Asset"
 }
@@ -131,3 +147,115 @@ func (a Sensor) GetId() interface{} {
 	}
 	return *a.Id
 }
+
+func (a WorkOrderTest) GetModelName() string {
+	return "WorkOrder"
+}
+
+func (a WorkOrderTest) GetTableName() string {
+	return "WorkOrder"
+}
+
+func (a WorkOrderTest) GetPluralModelName() string {
+	return "WorkOrders"
+}
+
+func (a WorkOrderTest) GetConnectorName() string {
+	return "db"
+}
+
+func (a WorkOrderTest) GetId() interface{} {
+	if a.Id == nil {
+		return nil
+	}
+	return *a.Id
+}
+
+func (a FeatureTest) GetModelName() string {
+	return "Feature"
+}
+
+func (a FeatureTest) GetTableName() string {
+	return "Feature"
+}
+
+func (a FeatureTest) GetPluralModelName() string {
+	return "Features"
+}
+
+func (a FeatureTest) GetConnectorName() string {
+	return "db"
+}
+
+func (a FeatureTest) GetId() interface{} {
+	if a.Id == nil {
+		return nil
+	}
+	return *a.Id
+}
+
+type JobTest struct {
+	PersistedModelWithId `bson:",inline" json:",inline"`
+	JobFields            `bson:",inline" json:",inline"`
+
+	Name string `bson:"name,omitempty" json:"name,omitempty"`
+}
+
+func (a JobTest) GetModelName() string {
+	return "Job"
+}
+
+func (a JobTest) GetTableName() string {
+	return "Job"
+}
+
+func (a JobTest) GetPluralModelName() string {
+	return "Jobs"
+}
+
+func (a JobTest) GetConnectorName() string {
+	return "db"
+}
+
+func (a JobTest) GetId() interface{} {
+	if a.Id == nil {
+		return nil
+	}
+	return *a.Id
+}
+
+// ZoneTest has sub-documents with fields named like operators, and no top level field with those names.
+type ZoneTest struct {
+	PersistedModelWithId `bson:",inline" json:",inline"`
+
+	Name *string `bson:"name,omitempty" json:"name,omitempty"`
+	Area *struct {
+		Type        string        `bson:"type,omitempty" json:"type,omitempty"`
+		Coordinates []interface{} `bson:"coordinates,omitempty" json:"coordinates,omitempty"`
+	} `bson:"area,omitempty" json:"area,omitempty"`
+	Metadata interface{}       `bson:"metadata,omitempty" json:"metadata,omitempty"`
+	Sensors  []MeasurementTest `bson:"sensors,omitempty" json:"sensors,omitempty"`
+}
+
+func (a ZoneTest) GetModelName() string {
+	return "Zone"
+}
+
+func (a ZoneTest) GetTableName() string {
+	return "Zone"
+}
+
+func (a ZoneTest) GetPluralModelName() string {
+	return "Zones"
+}
+
+func (a ZoneTest) GetConnectorName() string {
+	return "db"
+}
+
+func (a ZoneTest) GetId() interface{} {
+	if a.Id == nil {
+		return nil
+	}
+	return *a.Id
+}
@@ -0,0 +1,180 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+const (
+	LabelNetworkError        = "NetworkError"
+	LabelRetryableWriteError = "RetryableWriteError"
+)
+
+// DefaultRetryableLabels are the error labels retried when the policy has no labels.
+var DefaultRetryableLabels = []string{LabelNetworkError, LabelRetryableWriteError}
+
+// RetryPolicy retries the repository operations that fail with a transient error, like a network error during a
+// primary stepdown. The reads are retried on any retryable error, while the writes are only retried when the
+// server labels them as RetryableWriteError, or when they are idempotent: updates and upserts by id that only set
+// or unset fields. The retries share the timeout of the operation.
+type RetryPolicy struct {
+	MaxAttempts     int           // Attempts of an operation, including the first one. Defaults to 3
+	MinBackoff      time.Duration // Delay after the first failed attempt. Defaults to 50ms
+	MaxBackoff      time.Duration // Upper bound of the delay between attempts. Defaults to 1s
+	Jitter          float64       // Fraction of the delay that is randomized. Defaults to 0.5, a negative value disables it
+	RetryableLabels []string      // Error labels that make an error transient. Defaults to DefaultRetryableLabels
+}
+
+// SetRetryPolicy enables the retries of the repository operations. They are disabled by default.
+func (receiver *MongoDatasource) SetRetryPolicy(policy RetryPolicy) {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 3
+	}
+
+	if policy.MinBackoff <= 0 {
+		policy.MinBackoff = 50 * time.Millisecond
+	}
+
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = time.Second
+	}
+
+	if policy.Jitter == 0 {
+		policy.Jitter = 0.5
+	} else if policy.Jitter > 1 {
+		policy.Jitter = 1
+	}
+
+	if len(policy.RetryableLabels) == 0 {
+		policy.RetryableLabels = DefaultRetryableLabels
+	}
+
+	receiver.retryPolicy = &policy
+}
+
+// getRetryPolicy returns nil when the retries are disabled. The receiver can be nil.
+func (receiver *MongoDatasource) getRetryPolicy() *RetryPolicy {
+	if receiver == nil {
+		return nil
+	}
+
+	return receiver.retryPolicy
+}
+
+// retryable tells whether the failed operation can run again. A write that is not idempotent may have been applied
+// when the connection dropped, so it is only retried when the server says it was not.
+func (policy *RetryPolicy) retryable(err error, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	// The operation was not sent to any server
+	var selectionErr topology.ServerSelectionError
+	if errors.As(err, &selectionErr) {
+		return true
+	}
+
+	var labeled interface{ HasErrorLabel(string) bool }
+	if !errors.As(err, &labeled) {
+		return false
+	}
+
+	for _, label := range policy.RetryableLabels {
+		if !labeled.HasErrorLabel(label) {
+			continue
+		}
+
+		if idempotent || label == LabelRetryableWriteError {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backoff returns the delay before the attempt that follows the given one.
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := exponentialBackoff(attempt, policy.MinBackoff, policy.MaxBackoff)
+	if policy.Jitter > 0 {
+		delay -= time.Duration(policy.Jitter * rand.Float64() * float64(delay))
+	}
+
+	return delay
+}
+
+// retry runs fn, guarded by the circuit breaker and the in-flight limit, and runs it again while it fails with a
+// retryable error, the policy allows more attempts and ctx is not done. The slot of the in-flight limit is held
+// until the last attempt ends, backoffs included. operation can be nil.
+func (repository *MongoRepository[T]) retry(ctx context.Context, operation *Operation, idempotent bool, fn func() error) error {
+	policy := repository.datasource.getRetryPolicy()
+
+	release, err := repository.acquireSlot()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for attempt := 1; ; attempt++ {
+		err := repository.guardCircuit(fn)
+		if err == nil || policy == nil || attempt >= policy.MaxAttempts || !policy.retryable(err, idempotent) {
+			return err
+		}
+
+		delay := policy.backoff(attempt)
+		operationName := ""
+		if operation != nil {
+			operation.Retries++
+			operationName = operation.Name
+		}
+		repository.datasource.getLogger().Warn("retrying repository operation",
+			"model", repository.schema.Name,
+			"operation", operationName,
+			"attempt", attempt,
+			"delay", delay,
+			"error", err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isIdempotentUpdate tells whether running the update twice leaves the same document: the query selects a single
+// document by id and the update only sets or unsets fields. The query is the parsed where, before fixQuery.
+func isIdempotentUpdate(query bson.M, update bson.M) bool {
+	switch query["_id"].(type) {
+	case nil, bson.M, bson.D, map[string]interface{}:
+		return false
+	}
+
+	for operator := range update {
+		switch operator {
+		case "$set", "$setOnInsert", "$unset", "$currentDate":
+		default:
+			return false
+		}
+	}
+
+	return len(update) > 0
+}
+
+// hasWriteStage tells whether the pipeline writes its results in a collection, so it cannot be retried.
+func hasWriteStage(pipeline []bson.M) bool {
+	for _, stage := range pipeline {
+		for name := range stage {
+			if name == "$out" || name == "$merge" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
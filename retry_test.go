@@ -0,0 +1,157 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+func TestRetryPolicyRetryable(t *testing.T) {
+	datasource := &MongoDatasource{}
+	datasource.SetRetryPolicy(RetryPolicy{})
+	policy := datasource.getRetryPolicy()
+
+	networkErr := mongo.CommandError{Message: "connection reset", Labels: []string{LabelNetworkError}}
+	retryableWriteErr := mongo.CommandError{Message: "not primary", Labels: []string{LabelRetryableWriteError}}
+
+	cases := []struct {
+		err        error
+		idempotent bool
+		expected   bool
+	}{
+		{err: networkErr, idempotent: true, expected: true},
+		{err: networkErr, idempotent: false, expected: false},
+		{err: fmt.Errorf("find: %w", networkErr), idempotent: true, expected: true},
+		{err: retryableWriteErr, idempotent: false, expected: true},
+		{err: topology.ServerSelectionError{}, idempotent: false, expected: true},
+		{err: context.DeadlineExceeded, idempotent: true, expected: false},
+		{err: mongo.ErrNoDocuments, idempotent: true, expected: false},
+	}
+
+	for i, c := range cases {
+		if policy.retryable(c.err, c.idempotent) != c.expected {
+			t.Fatalf("case %d: expected %v for %v", i, c.expected, c.err)
+		}
+	}
+
+	for attempt := 1; attempt < 10; attempt++ {
+		delay := policy.backoff(attempt)
+		maxDelay := exponentialBackoff(attempt, policy.MinBackoff, policy.MaxBackoff)
+		if delay > maxDelay || delay < maxDelay/2 {
+			t.Fatalf("attempt %d: the delay %s is out of the jitter range", attempt, delay)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	datasource := &MongoDatasource{}
+	datasource.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, Jitter: -1})
+	repository := &MongoRepository[AssetTest]{schema: NewSchema(AssetTest{}), datasource: datasource}
+
+	networkErr := mongo.CommandError{Labels: []string{LabelNetworkError}}
+	failing := func(failures int, err error) (func() error, *int) {
+		attempts := 0
+		return func() error {
+			attempts++
+			if attempts <= failures {
+				return err
+			}
+			return nil
+		}, &attempts
+	}
+
+	operation, _ := repository.startOperation("Find")
+	fn, attempts := failing(2, networkErr)
+	if err := repository.retry(context.Background(), operation, true, fn); err != nil {
+		t.Fatal(err)
+	}
+	if *attempts != 3 || operation.Retries != 2 {
+		t.Fatalf("expected 3 attempts and 2 retries, got %d and %d", *attempts, operation.Retries)
+	}
+
+	fn, attempts = failing(5, networkErr)
+	if err := repository.retry(context.Background(), nil, true, fn); err == nil || *attempts != 3 {
+		t.Fatalf("expected an error after 3 attempts, got %v after %d", err, *attempts)
+	}
+
+	fn, attempts = failing(5, networkErr)
+	if err := repository.retry(context.Background(), nil, false, fn); err == nil || *attempts != 1 {
+		t.Fatalf("a write that is not idempotent must not be retried, got %d attempts", *attempts)
+	}
+
+	fn, attempts = failing(5, errors.New("duplicated key"))
+	if err := repository.retry(context.Background(), nil, true, fn); err == nil || *attempts != 1 {
+		t.Fatalf("a permanent error must not be retried, got %d attempts", *attempts)
+	}
+
+	repository.datasource = &MongoDatasource{}
+	fn, attempts = failing(5, networkErr)
+	if err := repository.retry(context.Background(), nil, true, fn); err == nil || *attempts != 1 {
+		t.Fatalf("the retries are disabled by default, got %d attempts", *attempts)
+	}
+}
+
+func TestIsIdempotentUpdate(t *testing.T) {
+	id := primitive.NewObjectID()
+	cases := []struct {
+		query    bson.M
+		update   bson.M
+		expected bool
+	}{
+		{query: bson.M{"_id": id}, update: bson.M{"$set": bson.M{"name": "a"}, "$currentDate": bson.M{"modified": true}}, expected: true},
+		{query: bson.M{"_id": id, "deleted": nil}, update: bson.M{"$unset": bson.M{"name": ""}}, expected: true},
+		{query: bson.M{"_id": id}, update: bson.M{"$inc": bson.M{"count": 1}}, expected: false},
+		{query: bson.M{"_id": bson.M{"$in": []interface{}{id}}}, update: bson.M{"$set": bson.M{"name": "a"}}, expected: false},
+		{query: bson.M{"name": "a"}, update: bson.M{"$set": bson.M{"name": "b"}}, expected: false},
+	}
+
+	for i, c := range cases {
+		if isIdempotentUpdate(c.query, c.update) != c.expected {
+			t.Fatalf("case %d: expected %v", i, c.expected)
+		}
+	}
+
+	if !hasWriteStage([]bson.M{{"$match": bson.M{}}, {"$merge": bson.M{"into": "Other"}}}) || hasWriteStage([]bson.M{{"$match": bson.M{}}}) {
+		t.Fatal("invalid write stage detection")
+	}
+}
+
+func TestUpdateByIdIdempotent(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instrumentation := &recordingInstrumentation{}
+	datasource := &MongoDatasource{}
+	datasource.AddInstrumentation(instrumentation)
+
+	repository := &MongoRepository[AssetTest]{
+		schema:         NewSchema(AssetTest{}),
+		collectionName: "Asset",
+		datasource:     datasource,
+		connector:      &MongoConnector{client: client, connected: true, options: &MongoConnectorOpts{Database: "test"}},
+		Options:        RepositoryOptions{Deleted: true},
+	}
+
+	if err := repository.UpdateById(primitive.NewObjectID(), bson.M{"name": "tank"}); err != mongo.ErrClientDisconnected {
+		t.Fatalf("expected ErrClientDisconnected, got %v", err)
+	}
+
+	operation := instrumentation.ended[0]
+	if !strings.HasPrefix(operation.Filter, `{"$and":`) {
+		t.Fatalf("the soft delete condition must be added, got %s", operation.Filter)
+	}
+	if !operation.idempotent {
+		t.Fatal("an update by id of a soft deleted repository must be idempotent")
+	}
+}
@@ -3,6 +3,7 @@ package go_mongo_repository
 import (
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -28,6 +29,23 @@ type FilterTags struct {
 	Fields FieldsOptions
 }
 
+type IndexType string
+
+const (
+	IndexAscending  IndexType = "1"
+	IndexDescending IndexType = "-1"
+	IndexText       IndexType = "text"
+	IndexGeo        IndexType = "2dsphere"
+	IndexHashed     IndexType = "hashed"
+)
+
+type IndexTags struct {
+	Type   IndexType
+	Unique bool
+	Sparse bool
+	Weight int32 // Weight of the field in the text index
+}
+
 type Field struct {
 	FieldName         string
 	BsonName          string
@@ -39,6 +57,9 @@ type Field struct {
 	StructField       reflect.StructField
 	Tag               reflect.StructTag
 	FilterTags        FilterTags
+	Sequence          string            // Counter assigned to the field on insert, set with the lb_seq tag
+	ElementFields     map[string]*Field // Fields of the elements of an array of sub-documents, by json name
+	Index             *IndexTags        // Index declared with the lb_index tag
 }
 
 type Schema struct {
@@ -49,8 +70,13 @@ type Schema struct {
 	Fields               map[string]*Field
 	RequiredFilterFields map[string]*Field
 	BannedFields         map[string]*Field
+	SequenceFields       map[string]*Field
+	IndexedFields        map[string]*Field
 	Relations            []Relation
 	ReflectValue         reflect.Value
+	ParseErrors          []error // Fields whose tags could not be parsed, they are left out of the schema
+
+	visiting map[reflect.Type]bool // Element types being parsed, to stop on recursive types
 }
 
 type RelationType string
@@ -83,6 +109,8 @@ func NewSchema(model IModel) *Schema {
 		Fields:               map[string]*Field{},
 		RequiredFilterFields: map[string]*Field{},
 		BannedFields:         map[string]*Field{},
+		SequenceFields:       map[string]*Field{},
+		IndexedFields:        map[string]*Field{},
 		ReflectValue:         val,
 	}
 
@@ -98,7 +126,7 @@ func (s *Schema) InitFields(val *reflect.Value, jsonParentField string, bsonPare
 	for i := 0; i < val.Type().NumField(); i++ {
 		field := val.Type().Field(i)
 		if err := s.InitField(field, jsonParentField, bsonParentField); err != nil {
-			fmt.Println(err)
+			s.ParseErrors = append(s.ParseErrors, err)
 		}
 	}
 }
@@ -113,11 +141,19 @@ func (s *Schema) AddField(field *Field, topLevelField bool) {
 			s.RequiredFilterFields[field.FieldName] = field
 		}
 
+		if field.Sequence != "" {
+			s.SequenceFields[field.FieldName] = field
+		}
+
 		/*if field.BsonName != "" {
 			s.FieldsByBSONName[field.BsonName] = field
 		}*/
 	}
 
+	if field.Index != nil {
+		s.IndexedFields[field.BsonName] = field
+	}
+
 	s.JSONFields[field.JsonName] = field
 }
 
@@ -171,6 +207,10 @@ func (s *Schema) InitField(fieldStruct reflect.StructField, jsonParentField stri
 	bsonTags, _ := parseFieldTags(fieldStruct, "bson")
 	jsonTags, _ := parseFieldTags(fieldStruct, "json")
 	filterTags, _ := parseFilterTags(fieldStruct)
+	indexTags, err := parseIndexTags(fieldStruct)
+	if err != nil {
+		return err
+	}
 
 	fieldType := fieldStruct.Type
 
@@ -194,6 +234,8 @@ func (s *Schema) InitField(fieldStruct reflect.StructField, jsonParentField stri
 		FieldType:         fieldType,
 		IndirectFieldType: fieldType,
 		FilterTags:        filterTags,
+		Sequence:          parseSequenceTag(fieldStruct, s.Name, bsonTags.Name),
+		Index:             indexTags,
 	}
 
 	isPointer := false
@@ -235,6 +277,7 @@ func (s *Schema) InitField(fieldStruct reflect.StructField, jsonParentField stri
 			s.AddField(&field, topLevelField)
 		} else if !fieldType.Implements(modelInterface) && !isRelation(fieldStruct) {
 			field.DataType = fieldType.Name()
+			field.ElementFields = s.elementFields(fieldType)
 			s.AddField(&field, topLevelField)
 		}
 	default:
@@ -245,6 +288,42 @@ func (s *Schema) InitField(fieldStruct reflect.StructField, jsonParentField stri
 	return nil
 }
 
+// elementFields parses the fields of the element type of an array, with names relative to the element.
+func (s *Schema) elementFields(elementType reflect.Type) map[string]*Field {
+	if elementType.Kind() == reflect.Ptr {
+		elementType = elementType.Elem()
+	}
+
+	if elementType.Kind() != reflect.Struct || s.visiting[elementType] {
+		return nil
+	}
+
+	switch reflect.Zero(elementType).Interface().(type) {
+	case time.Time, MongoDate:
+		return nil
+	}
+
+	visiting := map[reflect.Type]bool{elementType: true}
+	for visitedType := range s.visiting {
+		visiting[visitedType] = true
+	}
+
+	elementSchema := Schema{
+		Name:                 s.Name,
+		JSONFields:           map[string]*Field{},
+		Fields:               map[string]*Field{},
+		RequiredFilterFields: map[string]*Field{},
+		BannedFields:         map[string]*Field{},
+		SequenceFields:       map[string]*Field{},
+		IndexedFields:        map[string]*Field{},
+		visiting:             visiting,
+	}
+
+	elementValue := reflect.New(elementType).Elem()
+	elementSchema.InitFields(&elementValue, "", "")
+	return elementSchema.JSONFields
+}
+
 func isRelation(fieldStruct reflect.StructField) bool {
 	if !fieldStruct.IsExported() || fieldStruct.Tag.Get("bson") != "-" {
 		return false
@@ -319,6 +398,69 @@ func parseFilterTags(fieldStruct reflect.StructField) (FilterTags, error) {
 	return st, nil
 }
 
+// parseIndexTags parses the lb_index tag: the index type (asc, desc, text, 2dsphere or hashed) followed by the
+// unique, sparse and weight=<n> options.
+func parseIndexTags(fieldStruct reflect.StructField) (*IndexTags, error) {
+	tag, ok := fieldStruct.Tag.Lookup("lb_index")
+	if !ok {
+		return nil, nil
+	}
+
+	st := &IndexTags{Type: IndexAscending}
+	for idx, str := range strings.Split(tag, ",") {
+		str = strings.TrimSpace(str)
+		if idx == 0 {
+			switch str {
+			case "", "asc", "1":
+				st.Type = IndexAscending
+			case "desc", "-1":
+				st.Type = IndexDescending
+			case "text":
+				st.Type = IndexText
+			case "2dsphere":
+				st.Type = IndexGeo
+			case "hashed":
+				st.Type = IndexHashed
+			default:
+				return nil, fmt.Errorf("invalid index type %s in field %s", str, fieldStruct.Name)
+			}
+			continue
+		}
+
+		switch {
+		case str == "unique":
+			st.Unique = true
+		case str == "sparse":
+			st.Sparse = true
+		case strings.HasPrefix(str, "weight="):
+			weight, err := strconv.ParseInt(strings.TrimPrefix(str, "weight="), 10, 32)
+			if err != nil || weight < 1 {
+				return nil, fmt.Errorf("invalid index weight in field %s", fieldStruct.Name)
+			}
+			st.Weight = int32(weight)
+		default:
+			return nil, fmt.Errorf("invalid index option %s in field %s", str, fieldStruct.Name)
+		}
+	}
+
+	return st, nil
+}
+
+// parseSequenceTag returns the counter name of the lb_seq tag. An empty tag uses the model and field names.
+func parseSequenceTag(fieldStruct reflect.StructField, modelName string, bsonName string) string {
+	tag, ok := fieldStruct.Tag.Lookup("lb_seq")
+	if !ok {
+		return ""
+	}
+
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return modelName + "." + bsonName
+	}
+
+	return tag
+}
+
 func parseXSONTags(key string, tag string) (FieldTags, error) {
 	var st FieldTags
 	if tag == "-" {
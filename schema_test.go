@@ -14,3 +14,40 @@ func TestNewSchema(t *testing.T) {
 	fmt.Println(string(_json))*/
 
 }
+
+func TestSchemaSequenceFields(t *testing.T) {
+	schema := NewSchema(WorkOrderTest{})
+	if len(schema.SequenceFields) != 2 {
+		t.Fatalf("expected 2 sequence fields, got %d", len(schema.SequenceFields))
+	}
+
+	if sequence := schema.SequenceFields["Number"].Sequence; sequence != "WorkOrder.number" {
+		t.Fatalf("invalid default sequence name %s", sequence)
+	}
+
+	if sequence := schema.SequenceFields["LegacyCode"].Sequence; sequence != "legacy" {
+		t.Fatalf("invalid sequence name %s", sequence)
+	}
+}
+
+func TestIndexModels(t *testing.T) {
+	repository := &MongoRepository[AssetTest]{schema: NewSchema(AssetTest{})}
+	models := repository.IndexModels()
+	if len(models) != 2 {
+		t.Fatalf("expected 2 indexes, got %d", len(models))
+	}
+
+	_json, _ := json.Marshal(models[0].Keys)
+	if string(_json) != `[{"Key":"referenceId","Value":1}]` {
+		t.Fatalf("invalid index keys %s", _json)
+	}
+	if !*models[0].Options.Unique || !*models[0].Options.Sparse {
+		t.Fatal("the referenceId index must be unique and sparse")
+	}
+
+	// The text fields are combined in a single index
+	_json, _ = json.Marshal(models[1].Keys)
+	if string(_json) != `[{"Key":"description","Value":"text"},{"Key":"name","Value":"text"}]` {
+		t.Fatalf("invalid text index keys %s", _json)
+	}
+}
@@ -0,0 +1,241 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type SlowQueryRecorderOptions struct {
+	Threshold   time.Duration // Sets the slow query threshold of the datasource. Defaults to it, or 100ms when unset
+	TopN        int           // Shapes returned by TopQueries. Defaults to 20
+	MaxShapes   int           // Shapes kept in memory, the least costly one is evicted when full. Defaults to 1000
+	Explain     bool          // Explain the slow Find, FindOne and Count operations in the background
+	MaxExplains int           // Explains running at once, the slow operations are not explained beyond. Defaults to 1
+}
+
+// SlowQueryStats aggregates the slow operations that share the model, operation, filter shape and sort.
+type SlowQueryStats struct {
+	Model         string         `json:"model"`
+	Operation     string         `json:"operation"`
+	Filter        string         `json:"filter"`
+	Sort          string         `json:"sort,omitempty"`
+	Limit         int64          `json:"limit,omitempty"` // Limit of the last occurrence
+	Count         int64          `json:"count"`
+	TotalDuration time.Duration  `json:"totalDuration"`
+	MaxDuration   time.Duration  `json:"maxDuration"`
+	LastSeen      time.Time      `json:"lastSeen"`
+	Explain       *ExplainResult `json:"explain,omitempty"` // Plan of the last occurrence
+}
+
+type slowQueryKey struct {
+	model     string
+	operation string
+	filter    string
+	sort      string
+}
+
+// SlowQueryRecorder is an Instrumentation that keeps the worst shapes of the operations slower than the slow query
+// threshold of the datasource, which logs them, and explains their plan.
+type SlowQueryRecorder struct {
+	datasource *MongoDatasource
+	options    SlowQueryRecorderOptions
+	explains   chan struct{} // Bounds the explains running in the background
+	explaining sync.WaitGroup
+
+	mutex  sync.Mutex
+	shapes map[slowQueryKey]*SlowQueryStats
+}
+
+// NewSlowQueryRecorder creates the recorder and adds it to the instrumentations of the datasource.
+func NewSlowQueryRecorder(ds *MongoDatasource, opts SlowQueryRecorderOptions) *SlowQueryRecorder {
+	if opts.Threshold > 0 {
+		ds.SetSlowQueryThreshold(opts.Threshold)
+	} else {
+		ds.defaultSlowQueryThreshold(100 * time.Millisecond)
+	}
+
+	if opts.TopN <= 0 {
+		opts.TopN = 20
+	}
+
+	if opts.MaxShapes <= 0 {
+		opts.MaxShapes = 1000
+	}
+
+	if opts.MaxExplains <= 0 {
+		opts.MaxExplains = 1
+	}
+
+	recorder := &SlowQueryRecorder{
+		datasource: ds,
+		options:    opts,
+		explains:   make(chan struct{}, opts.MaxExplains),
+		shapes:     map[slowQueryKey]*SlowQueryStats{},
+	}
+	ds.AddInstrumentation(recorder)
+
+	return recorder
+}
+
+func (recorder *SlowQueryRecorder) StartOperation(ctx context.Context, _ *Operation) context.Context {
+	return ctx
+}
+
+// EndOperation records the slow operation and starts its explain, unless MaxExplains are already running. The
+// operation is not delayed by the explain.
+func (recorder *SlowQueryRecorder) EndOperation(_ context.Context, operation *Operation) {
+	threshold := recorder.datasource.getSlowQueryThreshold()
+	if threshold <= 0 || operation.Duration <= threshold {
+		return
+	}
+
+	key := slowQueryKey{model: operation.Model, operation: operation.Name, filter: operation.Filter, sort: operation.Sort}
+	recorder.record(key, operation)
+
+	if !recorder.options.Explain || operation.explain == nil {
+		return
+	}
+
+	select {
+	case recorder.explains <- struct{}{}:
+	default:
+		return
+	}
+
+	recorder.explaining.Add(1)
+	go func() {
+		defer recorder.explaining.Done()
+		defer func() { <-recorder.explains }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		explain, err := operation.Explain(ctx)
+		if err != nil || explain == nil {
+			return
+		}
+
+		recorder.datasource.getLogger().Warn("slow query plan",
+			"model", operation.Model,
+			"operation", operation.Name,
+			"filter", operation.Filter,
+			"sort", operation.Sort,
+			"limit", operation.Limit,
+			"duration", operation.Duration,
+			"stage", explain.Stage,
+			"index", explain.IndexName,
+			"collectionScan", explain.CollectionScan,
+		)
+		recorder.setExplain(key, explain)
+	}()
+}
+
+func (recorder *SlowQueryRecorder) record(key slowQueryKey, operation *Operation) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	stats, ok := recorder.shapes[key]
+	if !ok {
+		if len(recorder.shapes) >= recorder.options.MaxShapes {
+			recorder.evict()
+		}
+
+		stats = &SlowQueryStats{
+			Model:     operation.Model,
+			Operation: operation.Name,
+			Filter:    operation.Filter,
+			Sort:      operation.Sort,
+		}
+		recorder.shapes[key] = stats
+	}
+
+	stats.Limit = operation.Limit
+	stats.Count++
+	stats.TotalDuration += operation.Duration
+	if operation.Duration > stats.MaxDuration {
+		stats.MaxDuration = operation.Duration
+	}
+	stats.LastSeen = operation.Start
+}
+
+// setExplain keeps the plan of the shape, unless it was evicted or reset meanwhile.
+func (recorder *SlowQueryRecorder) setExplain(key slowQueryKey, explain *ExplainResult) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if stats, ok := recorder.shapes[key]; ok {
+		explain.Raw = nil
+		stats.Explain = explain
+	}
+}
+
+// evict removes the shape with the lowest total duration.
+func (recorder *SlowQueryRecorder) evict() {
+	var evictKey slowQueryKey
+	var evictStats *SlowQueryStats
+	for key, stats := range recorder.shapes {
+		if evictStats == nil || stats.TotalDuration < evictStats.TotalDuration {
+			evictKey = key
+			evictStats = stats
+		}
+	}
+
+	delete(recorder.shapes, evictKey)
+}
+
+// TopQueries returns the shapes with the greatest total duration, the worst first.
+func (recorder *SlowQueryRecorder) TopQueries() []SlowQueryStats {
+	recorder.mutex.Lock()
+	top := make([]SlowQueryStats, 0, len(recorder.shapes))
+	for _, stats := range recorder.shapes {
+		top = append(top, *stats)
+	}
+	recorder.mutex.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].TotalDuration != top[j].TotalDuration {
+			return top[i].TotalDuration > top[j].TotalDuration
+		}
+		return top[i].MaxDuration > top[j].MaxDuration
+	})
+
+	if len(top) > recorder.options.TopN {
+		top = top[:recorder.options.TopN]
+	}
+
+	return top
+}
+
+// waitBackground waits for the explains running in the background.
+func (recorder *SlowQueryRecorder) waitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		recorder.explaining.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Reset discards the recorded shapes.
+func (recorder *SlowQueryRecorder) Reset() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	recorder.shapes = map[slowQueryKey]*SlowQueryStats{}
+}
+
+// ServeHTTP serves TopQueries as JSON.
+func (recorder *SlowQueryRecorder) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(recorder.TopQueries())
+}
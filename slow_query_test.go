@@ -0,0 +1,124 @@
+package go_mongo_repository
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xompass/lbq"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestSlowQueryRecorder(t *testing.T) {
+	logger := &recordingLogger{}
+	datasource := &MongoDatasource{}
+	datasource.SetLogger(logger)
+
+	recorder := NewSlowQueryRecorder(datasource, SlowQueryRecorderOptions{Threshold: 10 * time.Millisecond, TopN: 2, MaxShapes: 2, Explain: true})
+	if datasource.getSlowQueryThreshold() != 10*time.Millisecond {
+		t.Fatal("the threshold of the recorder must be the one of the datasource")
+	}
+
+	var explained int32
+	release := make(chan struct{})
+	end := func(name string, query bson.M, duration time.Duration) {
+		operation := &Operation{Model: "Asset", Name: name, Start: time.Now(), Duration: duration}
+		operation.setQuery(query)
+		operation.setFind(bson.D{{Key: "name", Value: 1}}, nil, func(ctx context.Context) (*ExplainResult, error) {
+			atomic.AddInt32(&explained, 1)
+			<-release
+			return &ExplainResult{Stage: "COLLSCAN", CollectionScan: true}, nil
+		})
+		recorder.EndOperation(context.Background(), operation)
+	}
+
+	// The first explain blocks, so the next slow operations are recorded without being explained
+	end("Find", bson.M{"name": "a"}, time.Millisecond) // Fast, ignored
+	end("Find", bson.M{"name": "a"}, 50*time.Millisecond)
+	end("Find", bson.M{"name": "b"}, 70*time.Millisecond) // Same shape
+	end("Count", bson.M{"status": 1}, 20*time.Millisecond)
+	end("FindOne", bson.M{"type": "x"}, 30*time.Millisecond) // Evicts the Count shape
+
+	// Shutdown waits for the explain
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := datasource.Shutdown(ctx); err == nil {
+		t.Fatal("expected an error while the explain is running")
+	}
+
+	close(release)
+	if err := datasource.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if atomic.LoadInt32(&explained) != 1 || len(logger.entries) != 1 || logger.entries[0].msg != "slow query plan" {
+		t.Fatalf("expected a single explain, got %d explains and %d logs", explained, len(logger.entries))
+	}
+	if logger.entries[0].arg("duration") != 50*time.Millisecond || logger.entries[0].arg("limit") != int64(0) {
+		t.Fatalf("the plan must be logged with the duration and limit, got %v", logger.entries[0].args)
+	}
+
+	top := recorder.TopQueries()
+	if len(top) != 2 {
+		t.Fatalf("expected 2 shapes, got %d", len(top))
+	}
+
+	if top[0].Operation != "Find" || top[0].Count != 2 || top[0].TotalDuration != 120*time.Millisecond ||
+		top[0].MaxDuration != 70*time.Millisecond || top[0].Filter != `{"name":"?"}` || top[0].Sort != "name:1" {
+		t.Fatalf("invalid worst shape %+v", top[0])
+	}
+
+	if top[0].Explain == nil || !top[0].Explain.CollectionScan || top[1].Operation != "FindOne" || top[1].Explain != nil {
+		t.Fatalf("invalid plans %+v", top)
+	}
+
+	recorder.Reset()
+	response := httptest.NewRecorder()
+	recorder.ServeHTTP(response, httptest.NewRequest("GET", "/", nil))
+
+	var served []SlowQueryStats
+	if err := json.Unmarshal(response.Body.Bytes(), &served); err != nil || len(served) != 0 {
+		t.Fatalf("invalid response %s", response.Body.String())
+	}
+}
+
+func TestInternalExplainsBypassGuard(t *testing.T) {
+	client, err := mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	connector := &MongoConnector{
+		client:    client,
+		connected: true,
+		options:   &MongoConnectorOpts{Name: "db", Database: "test"},
+		breaker:   newCircuitBreaker(CircuitBreakerOptions{FailureThreshold: 1}),
+	}
+	repository := &MongoRepository[AssetTest]{
+		schema:         NewSchema(AssetTest{}),
+		collectionName: "Asset",
+		connector:      connector,
+		datasource:     &MongoDatasource{},
+		bulkhead:       make(chan struct{}, 1),
+	}
+
+	// The bulkhead is full, the explain of a slow query runs anyway and its failure does not open the circuit
+	repository.bulkhead <- struct{}{}
+	_, err = repository.explainContext(context.Background(), repository.findCommand(bson.M{}, nil, &QueryOptions{}), ExplainQueryPlanner)
+	if err != mongo.ErrClientDisconnected {
+		t.Fatalf("expected ErrClientDisconnected, got %v", err)
+	}
+	if connector.CircuitState() != CircuitClosed {
+		t.Fatalf("an internal explain must not open the circuit, got %s", connector.CircuitState())
+	}
+
+	// The explains requested by the caller are guarded
+	if _, err := repository.Explain(lbq.Filter{}, ExplainQueryPlanner); err != ErrTooManyInFlight {
+		t.Fatalf("expected ErrTooManyInFlight, got %v", err)
+	}
+}
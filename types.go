@@ -17,7 +17,6 @@ func (date *MongoDate) UnmarshalBSON(data []byte) error {
 	dateReader := bsonrw.NewBSONValueReader(bsontype.DateTime, data)
 	milliseconds, err := dateReader.ReadDateTime()
 	if err != nil {
-		fmt.Println("error", err)
 		return err
 	}
 